@@ -0,0 +1,88 @@
+package src
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/inuws"
+)
+
+var (
+	// session of whoever has control
+	controllerSession      string
+	controllerSessionMutex sync.Mutex
+)
+
+func isAdmin(r *http.Request) bool {
+	if config.ADMIN_TOKEN == "" {
+		return false
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(
+		[]byte(token), []byte(config.ADMIN_TOKEN),
+	) == 1
+}
+
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.ADMIN_TOKEN == "" {
+			http.Error(w, "admin api disabled", http.StatusNotFound)
+			return
+		}
+
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// the session comes from the query since browsers cant set headers on links
+func isController(r *http.Request) bool {
+	controllerSessionMutex.Lock()
+	defer controllerSessionMutex.Unlock()
+
+	session := r.URL.Query().Get("session")
+	return session != "" && session == controllerSession
+}
+
+func controllerOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isController(r) && !isAdmin(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func processesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(processes.Status())
+}
+
+func initAdmin(httpMux *http.ServeMux) {
+	inuws.ControllerSignal.AddListener(
+		func(ctx context.Context, session string) {
+			controllerSessionMutex.Lock()
+			controllerSession = session
+			controllerSessionMutex.Unlock()
+		},
+	)
+
+	httpMux.HandleFunc("GET /api/admin/processes", adminOnly(processesHandler))
+}
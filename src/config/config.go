@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // TODO: unset them perhaps
@@ -10,8 +12,29 @@ import (
 var (
 	WEB_PORT, _ = strconv.Atoi(getEnv("WEB_PORT", "4845"))
 	UDP_PORT, _ = strconv.Atoi(getEnv("UDP_PORT", "4845"))
+	// ice-tcp for networks that block udp, off when 0. set it to WEB_PORT
+	// to share the http listener, or any other port for its own
+	TCP_PORT, _ = strconv.Atoi(getEnv("TCP_PORT", "0"))
 
-	PUBLIC_IP = getEnv("PUBLIC_IP", "")
+	// nat 1 to 1, comma separated. an ip that every local address of its
+	// family is advertised as, or external/local pairs. ipv4 and ipv6
+	PUBLIC_IP = getEnvList("PUBLIC_IP")
+	// only make candidates from these, all if empty
+	ICE_INTERFACES = getEnvList("ICE_INTERFACES")
+	ICE_ADDRESSES  = getEnvList("ICE_ADDRESSES")
+
+	// embedded turn server for viewers behind symmetric nats
+	TURN         = envExists("TURN")
+	TURN_PORT, _ = strconv.Atoi(getEnv("TURN_PORT", "3478"))
+	TURN_REALM   = getEnv("TURN_REALM", "inu-desktop")
+	// fixed credentials, otherwise time limited ones are made from the secret
+	TURN_USERNAME = getEnv("TURN_USERNAME", "")
+	TURN_PASSWORD = getEnv("TURN_PASSWORD", "")
+	// random if empty, set it to share with another turn server
+	TURN_SECRET            = getEnv("TURN_SECRET", "")
+	TURN_CREDENTIAL_TTL, _ = time.ParseDuration(getEnv("TURN_CREDENTIAL_TTL", "24h"))
+	TURN_RELAY_MIN_PORT, _ = strconv.Atoi(getEnv("TURN_RELAY_MIN_PORT", "49160"))
+	TURN_RELAY_MAX_PORT, _ = strconv.Atoi(getEnv("TURN_RELAY_MAX_PORT", "49200"))
 
 	IN_CONTAINER = envExists("IN_CONTAINER")
 
@@ -19,8 +42,52 @@ var (
 	SCREEN_HEIGHT, _ = strconv.Atoi(getEnv("SCREEN_HEIGHT", "1080"))
 	FRAMERATE, _     = strconv.Atoi(getEnv("FRAMERATE", "60"))
 
+	// lower framerate when nothing on screen has changed for a while
+	ADAPTIVE_FRAMERATE = envExists("ADAPTIVE_FRAMERATE")
+	IDLE_FRAMERATE, _  = strconv.Atoi(getEnv("IDLE_FRAMERATE", "5"))
+	IDLE_TIMEOUT, _    = time.ParseDuration(getEnv("IDLE_TIMEOUT", "3s"))
+
+	// keep encoding after the last viewer leaves, so reloads are instant
+	PIPELINE_LINGER, _ = time.ParseDuration(getEnv("PIPELINE_LINGER", "10s"))
+	// start encoding when the page opens rather than when webrtc connects
+	PREWARM_PIPELINES = envExists("PREWARM_PIPELINES")
+
+	// push the desktop to a whip server, counts as a viewer
+	WHIP_URL   = getEnv("WHIP_URL", "")
+	WHIP_TOKEN = getEnv("WHIP_TOKEN", "")
+
+	// segmented output under /hls/ for players that cant do webrtc
+	HLS = envExists("HLS")
+	// cut on the webrtc encode's keyframes, so no shorter than its gop
+	HLS_SEGMENT_DURATION, _ = time.ParseDuration(getEnv("HLS_SEGMENT_DURATION", "2s"))
+	HLS_PLAYLIST_LENGTH, _  = strconv.Atoi(getEnv("HLS_PLAYLIST_LENGTH", "6"))
+	// stops encoding when no player has fetched anything for this long
+	HLS_IDLE_TIMEOUT, _ = time.ParseDuration(getEnv("HLS_IDLE_TIMEOUT", "30s"))
+
+	// mkv or mp4, saved in DATA_DIR/recordings
+	RECORDING_FORMAT = getEnv("RECORDING_FORMAT", "mkv")
+	// record whenever someone has control
+	AUTO_RECORD = envExists("AUTO_RECORD")
+
+	// keep the last few minutes in memory so clips can be saved
+	REPLAY                = envExists("REPLAY")
+	REPLAY_DURATION, _    = time.ParseDuration(getEnv("REPLAY_DURATION", "5m"))
+	REPLAY_BUFFER_SIZE, _ = strconv.Atoi(getEnv("REPLAY_BUFFER_SIZE", "256")) // mb
+	// controller, anyone or admin
+	REPLAY_SAVE = getEnv("REPLAY_SAVE", "controller")
+
 	USE_NVIDIA = envExists("USE_NVIDIA")
 
+	// balanced, motion, text or game. can be changed with the admin api.
+	// game needs x264 and in process gstreamer
+	QUALITY_PROFILE = getEnv("QUALITY_PROFILE", "balanced")
+
+	// bearer token for /api/admin, admin api is disabled if empty
+	ADMIN_TOKEN = getEnv("ADMIN_TOKEN", "")
+
+	// settings changed at runtime are saved here
+	DATA_DIR = getEnv("DATA_DIR", "/home/inu/persist/.inu-desktop")
+
 	SUPERVISOR_LOGS = envExists("SUPERVISOR_LOGS")
 )
 
@@ -33,6 +100,17 @@ func getEnv(key string, fallback string) string {
 	}
 }
 
+func getEnvList(key string) []string {
+	var values []string
+	for value := range strings.SplitSeq(getEnv(key, ""), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func envExists(key string) bool {
 	_, exists := os.LookupEnv(key)
 	return exists
@@ -0,0 +1,269 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/inuwebrtc"
+	"github.com/makinori/inu-desktop/src/inuws"
+)
+
+// starts pipelines as soon as someone needs them but keeps them running
+// for a while after, so reloading the page doesnt rebuild the encoder
+
+type controlledPipeline struct {
+	viewers uint32
+	// like pushes, which arent webrtc viewers
+	holders int
+	running bool
+	// wont stop before this, even without viewers
+	lingerUntil time.Time
+	timer       *time.Timer
+}
+
+type controlledPipelineState struct {
+	ID      string     `json:"id"`
+	Running bool       `json:"running"`
+	Viewers uint32     `json:"viewers"`
+	Holders int        `json:"holders"`
+	StopAt  *time.Time `json:"stopAt,omitempty"`
+}
+
+var (
+	controlledPipelines = map[string]*controlledPipeline{
+		"gst-video":          {},
+		"gst-video-fallback": {},
+		"gst-audio":          {},
+	}
+	controlledPipelineIDs    = []string{"gst-video", "gst-video-fallback", "gst-audio"}
+	controlledPipelinesMutex sync.Mutex
+)
+
+// for pipelines that are only started with holdPipeline
+func addControlledPipeline(id string) {
+	controlledPipelinesMutex.Lock()
+	defer controlledPipelinesMutex.Unlock()
+
+	controlledPipelines[id] = &controlledPipeline{}
+	controlledPipelineIDs = append(controlledPipelineIDs, id)
+}
+
+func (pipeline *controlledPipeline) inUse() bool {
+	return pipeline.viewers > 0 || pipeline.holders > 0
+}
+
+// must be called with mutex locked
+func (pipeline *controlledPipeline) start(id string) {
+	if pipeline.timer != nil {
+		pipeline.timer.Stop()
+		pipeline.timer = nil
+	}
+
+	if pipeline.running {
+		return
+	}
+
+	pipeline.running = true
+	processes.Start(id)
+}
+
+// must be called with mutex locked
+func (pipeline *controlledPipeline) scheduleStop(id string) {
+	if !pipeline.running || pipeline.inUse() {
+		return
+	}
+
+	if pipeline.timer != nil {
+		pipeline.timer.Stop()
+		pipeline.timer = nil
+	}
+
+	wait := time.Until(pipeline.lingerUntil)
+	if wait <= 0 {
+		pipeline.running = false
+		processes.Stop(id)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		controlledPipelinesMutex.Lock()
+		defer controlledPipelinesMutex.Unlock()
+
+		// stopped timers can still fire if they were already waiting
+		if pipeline.timer != timer {
+			return
+		}
+
+		pipeline.timer = nil
+		if !pipeline.inUse() && pipeline.running {
+			slog.Info("stopping idle pipeline", "id", id)
+			pipeline.running = false
+			processes.Stop(id)
+		}
+	})
+	pipeline.timer = timer
+}
+
+func setPipelineViewers(id string, viewers uint32) {
+	controlledPipelinesMutex.Lock()
+	defer controlledPipelinesMutex.Unlock()
+
+	pipeline := controlledPipelines[id]
+	if pipeline.viewers == viewers {
+		return
+	}
+
+	wasInUse := pipeline.inUse()
+	pipeline.viewers = viewers
+	pipeline.update(id, wasInUse)
+}
+
+// keeps a pipeline running until released
+func acquirePipeline(id string) {
+	controlledPipelinesMutex.Lock()
+	defer controlledPipelinesMutex.Unlock()
+
+	pipeline := controlledPipelines[id]
+	wasInUse := pipeline.inUse()
+	pipeline.holders++
+	pipeline.update(id, wasInUse)
+}
+
+func releasePipeline(id string) {
+	controlledPipelinesMutex.Lock()
+	defer controlledPipelinesMutex.Unlock()
+
+	pipeline := controlledPipelines[id]
+	wasInUse := pipeline.inUse()
+	pipeline.holders = max(pipeline.holders-1, 0)
+	pipeline.update(id, wasInUse)
+}
+
+// must be called with mutex locked
+func (pipeline *controlledPipeline) update(id string, wasInUse bool) {
+	if pipeline.inUse() {
+		pipeline.start(id)
+		return
+	}
+
+	if wasInUse {
+		pipeline.lingerUntil = time.Now().Add(config.PIPELINE_LINGER)
+	}
+	pipeline.scheduleStop(id)
+}
+
+// runs a pipeline for a while without any viewers,
+// so it's already encoding when they arrive
+func holdPipeline(id string, duration time.Duration) {
+	controlledPipelinesMutex.Lock()
+	defer controlledPipelinesMutex.Unlock()
+
+	pipeline := controlledPipelines[id]
+	if pipeline.inUse() {
+		return
+	}
+
+	lingerUntil := time.Now().Add(duration)
+	if lingerUntil.After(pipeline.lingerUntil) {
+		pipeline.lingerUntil = lingerUntil
+	}
+
+	pipeline.start(id)
+	pipeline.scheduleStop(id)
+}
+
+func isControlledPipelineRunning(id string) bool {
+	controlledPipelinesMutex.Lock()
+	defer controlledPipelinesMutex.Unlock()
+	return controlledPipelines[id].running
+}
+
+func updateControlledPipelines() {
+	fallback := inuwebrtc.FallbackViewerCount.Load()
+	total := inuwebrtc.ViewerCount.Load()
+
+	desktop := max(total, fallback) - fallback
+
+	setPipelineViewers("gst-video", desktop)
+	setPipelineViewers("gst-audio", total)
+
+	// replay buffers what desktop viewers see, which has to be h264
+	if config.REPLAY && getH264VideoStream() == "video-fallback" {
+		setPipelineViewers("gst-video-fallback", fallback+desktop)
+	} else {
+		setPipelineViewers("gst-video-fallback", fallback)
+	}
+}
+
+func getControlledPipelineStates() []controlledPipelineState {
+	controlledPipelinesMutex.Lock()
+	defer controlledPipelinesMutex.Unlock()
+
+	states := []controlledPipelineState{}
+
+	for _, id := range controlledPipelineIDs {
+		pipeline := controlledPipelines[id]
+
+		state := controlledPipelineState{
+			ID:      id,
+			Running: pipeline.running,
+			Viewers: pipeline.viewers,
+			Holders: pipeline.holders,
+		}
+
+		if pipeline.running && !pipeline.inUse() {
+			stopAt := pipeline.lingerUntil
+			state.StopAt = &stopAt
+		}
+
+		states = append(states, state)
+	}
+
+	return states
+}
+
+func controllerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"linger":    config.PIPELINE_LINGER.String(),
+		"prewarm":   config.PREWARM_PIPELINES,
+		"pipelines": getControlledPipelineStates(),
+	})
+}
+
+func initController(httpMux *http.ServeMux) {
+	httpMux.HandleFunc("GET /api/pipelines/controller", adminOnly(controllerHandler))
+
+	inuwebrtc.ViewerCountSignal.AddListener(
+		func(ctx context.Context, value uint32) {
+			updateControlledPipelines()
+		},
+	)
+
+	inuwebrtc.FallbackViewerCountSignal.AddListener(
+		func(ctx context.Context, value uint32) {
+			updateControlledPipelines()
+		},
+	)
+
+	if !config.PREWARM_PIPELINES {
+		return
+	}
+
+	// dont know if they need the fallback until the offer
+	inuws.ClientConnectedSignal.AddListener(
+		func(ctx context.Context, window uint32) {
+			if window != 0 {
+				return
+			}
+			holdPipeline("gst-video", config.PIPELINE_LINGER)
+			holdPipeline("gst-audio", config.PIPELINE_LINGER)
+		},
+	)
+}
@@ -2,12 +2,77 @@ package src
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
 
 	"github.com/makinori/inu-desktop/src/config"
 	"github.com/makinori/inu-desktop/src/supervisor"
 )
 
+const (
+	micSource   = "inu_mic"
+	micPipePath = "/tmp/inu-mic"
+	micRate     = 48000
+	micChannels = 1
+	// pipelines run as root, so they use inu's cookie
+	// on a socket that only inu and root can reach
+	pulseSocket = "/home/inu/.inu-pulse/native"
+	pulseServer = "unix:" + pulseSocket
+	pulseCookie = "/home/inu/.config/pulse/cookie"
+)
+
+// nobody should be heard when nobody has control
+func setMicMuted(muted bool) {
+	if !config.IN_CONTAINER {
+		return
+	}
+
+	value := "0"
+	if muted {
+		value = "1"
+	}
+
+	err := exec.Command(
+		"su", "inu", "-c", "pactl set-source-mute "+micSource+" "+value,
+	).Run()
+
+	if err != nil {
+		slog.Error("failed to set mic mute", "err", err.Error())
+	}
+}
+
+func makePulseSocketDir() {
+	inu, err := user.Lookup("inu")
+	if err != nil {
+		panic(err)
+	}
+
+	uid, _ := strconv.Atoi(inu.Uid)
+	gid, _ := strconv.Atoi(inu.Gid)
+
+	dir := filepath.Dir(pulseSocket)
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	// might be left over with other permissions
+	err = os.Chmod(dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.Chown(dir, uid, gid)
+	if err != nil {
+		panic(err)
+	}
+}
+
 func initDesktop() {
 	if config.USE_NVIDIA {
 		// os.Setenv("GBM_BACKEND", "nvidia-drm")
@@ -60,10 +125,23 @@ func initDesktop() {
 		})
 	}
 
+	// pipe source shows up as a microphone for desktop apps
+	micModule := fmt.Sprintf(
+		"module-pipe-source source_name=%s file=%s "+
+			"format=s16le rate=%d channels=%d "+
+			"source_properties=device.description=inu-microphone",
+		micSource, micPipePath, micRate, micChannels,
+	)
+
+	makePulseSocketDir()
+	os.Setenv("PULSE_COOKIE", pulseCookie)
+
+	socketModule := "module-native-protocol-unix socket=" + pulseSocket
+
 	runAsInu(
 		"pulseaudio",
 		"pulseaudio --disallow-module-loading --disallow-exit "+
-			"--exit-idle-time=-1",
+			"--exit-idle-time=-1 -L '"+micModule+"' -L '"+socketModule+"'",
 		false,
 	)
 
@@ -0,0 +1,260 @@
+package src
+
+import (
+	"fmt"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/inuwebrtc"
+)
+
+const (
+	// 4:2:0 constrained baseline, every browser can decode this
+	codecH264 = "h264"
+	// 4:4:4 high profile
+	codecH264444 = "h264-444"
+	// 4:4:4 profile 1
+	codecVP9444 = "vp9-444"
+)
+
+var (
+	// https://gstreamer.freedesktop.org/documentation/x264/index.html
+	x264RateControls = []string{"cbr", "quant", "qual"}
+	x264Presets      = []string{
+		"ultrafast", "superfast", "veryfast", "faster", "fast",
+		"medium", "slow", "slower", "veryslow",
+	}
+
+	// https://gstreamer.freedesktop.org/documentation/nvcodec/nvh264enc.html
+	nvh264RateControls = []string{"cbr", "vbr", "constqp"}
+	nvh264Presets      = []string{
+		"default", "hp", "hq", "low-latency", "low-latency-hq",
+		"low-latency-hp", "p1", "p2", "p3", "p4", "p5", "p6", "p7",
+	}
+
+	// https://gstreamer.freedesktop.org/documentation/vpx/vp9enc.html
+	vp9RateControls = []string{"cbr", "vbr", "cq"}
+	// cpu-used, higher is faster
+	vp9Presets = []string{"4", "5", "6", "7", "8"}
+)
+
+type encoderOptions struct {
+	Encoder      string   `json:"encoder"`
+	RateControls []string `json:"rateControls"`
+	Presets      []string `json:"presets"`
+	// property and multiplier for kbit/s
+	bitrateProperty string
+	bitrateScale    int
+}
+
+func getEncoderOptions(codec string) encoderOptions {
+	if codec == codecVP9444 {
+		return encoderOptions{
+			Encoder:         "vp9enc",
+			RateControls:    vp9RateControls,
+			Presets:         vp9Presets,
+			bitrateProperty: "target-bitrate",
+			bitrateScale:    1000,
+		}
+	}
+
+	if config.USE_NVIDIA {
+		return encoderOptions{
+			Encoder:         "nvh264enc",
+			RateControls:    nvh264RateControls,
+			Presets:         nvh264Presets,
+			bitrateProperty: "bitrate",
+			bitrateScale:    1,
+		}
+	}
+
+	return encoderOptions{
+		Encoder:         "x264enc",
+		RateControls:    x264RateControls,
+		Presets:         x264Presets,
+		bitrateProperty: "bitrate",
+		bitrateScale:    1,
+	}
+}
+
+type qualityProfile struct {
+	Codec       string
+	RateControl string
+	Preset      string
+	// keyframe interval
+	GOPSeconds int
+	// spreads keyframes across frames to avoid bitrate spikes
+	IntraRefresh bool
+}
+
+var qualityProfileNames = []string{"balanced", "motion", "text", "game"}
+
+// only the ones this encoder and gstreamer backend can do
+func getQualityProfileNames() []string {
+	var names []string
+	for _, name := range qualityProfileNames {
+		_, ok := getQualityProfile(name)
+		if ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func getQualityProfile(name string) (qualityProfile, bool) {
+	switch name {
+	case "balanced":
+		if config.USE_NVIDIA {
+			return qualityProfile{codecH264, "cbr", "low-latency-hp", 1, false}, true
+		}
+		return qualityProfile{codecH264, "cbr", "veryfast", 1, false}, true
+
+	case "motion":
+		if config.USE_NVIDIA {
+			return qualityProfile{codecH264, "cbr", "p1", 1, false}, true
+		}
+		return qualityProfile{codecH264, "cbr", "ultrafast", 1, false}, true
+
+	// coloured text and thin lines smear with 4:2:0.
+	// mostly static so keyframes can be further apart
+	case "text":
+		if config.USE_NVIDIA {
+			return qualityProfile{
+				codecH264444, "vbr", "low-latency-hq", 2, false,
+			}, true
+		}
+		// browsers decode vp9 4:4:4 more widely than h264 4:4:4
+		return qualityProfile{codecVP9444, "vbr", "6", 2, false}, true
+
+	// low latency without a burst every keyframe.
+	// new viewers get a keyframe on demand, which gst-launch cant do,
+	// and nvh264enc has no intra refresh
+	case "game":
+		if config.USE_NVIDIA || !canControlPipelines {
+			return qualityProfile{}, false
+		}
+		return qualityProfile{codecH264, "cbr", "superfast", 1, true}, true
+	}
+
+	return qualityProfile{}, false
+}
+
+func (settings streamSettings) getCodec() string {
+	profile, ok := getQualityProfile(settings.Profile)
+	if !ok {
+		return codecH264
+	}
+	return profile.Codec
+}
+
+// for window streams and viewers that cant decode the profile's codec
+func (settings streamSettings) getFallback() streamSettings {
+	profile, ok := getQualityProfile(settings.Profile)
+	if ok && profile.Codec == codecH264 {
+		return settings
+	}
+
+	balanced, _ := getQualityProfile("balanced")
+	settings.Profile = "balanced"
+	settings.RateControl = balanced.RateControl
+	settings.Preset = balanced.Preset
+
+	return settings
+}
+
+func setWebRTCCodec(codec string) {
+	switch codec {
+	case codecH264444:
+		inuwebrtc.SetVideoCodec(inuwebrtc.CodecH264High444)
+	case codecVP9444:
+		inuwebrtc.SetVideoCodec(inuwebrtc.CodecVP9Profile1)
+	default:
+		inuwebrtc.SetVideoCodec(inuwebrtc.CodecH264)
+	}
+}
+
+func getVideoEncoder(settings streamSettings) string {
+	bitrate := settings.VideoBitrate *
+		getEncoderOptions(settings.getCodec()).bitrateScale
+
+	if settings.getCodec() == codecVP9444 {
+		return "vp9enc name=encoder " +
+			fmt.Sprintf("target-bitrate=%d ", bitrate) +
+			"end-usage=" + settings.RateControl + " " +
+			"cpu-used=" + settings.Preset + " " +
+			"deadline=1 " + // realtime
+			"lag-in-frames=0 " +
+			"row-mt=true " +
+			"error-resilient=default " +
+			fmt.Sprintf("keyframe-max-dist=%d", settings.GOP)
+	}
+
+	if config.USE_NVIDIA {
+		return "nvh264enc name=encoder " +
+			fmt.Sprintf("bitrate=%d ", bitrate) +
+			"rc-mode=" + settings.RateControl + " " +
+			"tune=3 " + // Ultra low latency
+			"multi-pass=2 " + // Two pass with quarter resolution
+			"preset=" + settings.Preset + " " +
+			"zerolatency=true " +
+			// Number of frames between intra frames
+			fmt.Sprintf("gop-size=%d", settings.GOP)
+	}
+
+	videoEnc := "x264enc name=encoder " +
+		fmt.Sprintf("bitrate=%d ", bitrate) +
+		"pass=" + settings.RateControl + " " +
+		"tune=zerolatency " +
+		"speed-preset=" + settings.Preset + " " +
+		fmt.Sprintf("key-int-max=%d", settings.GOP)
+
+	profile, _ := getQualityProfile(settings.Profile)
+
+	if profile.IntraRefresh {
+		// one frame worth so there's never a burst
+		frameMs := max(1000/settings.Framerate, 1)
+
+		// key-int-max becomes how long a full refresh takes
+		videoEnc += " intra-refresh=true bframes=0 " +
+			fmt.Sprintf("vbv-buf-capacity=%d", frameMs)
+	}
+
+	return videoEnc
+}
+
+// raw video to rtp
+func getVideoEncoding(settings streamSettings) []string {
+	switch settings.getCodec() {
+	case codecH264444:
+		return []string{
+			"videoconvert",
+			"video/x-raw,format=Y444",
+			getVideoEncoder(settings),
+			"h264parse config-interval=-1",
+			"video/x-h264,stream-format=byte-stream,profile=high-4:4:4",
+			"rtph264pay",
+		}
+
+	case codecVP9444:
+		return []string{
+			"videoconvert",
+			"video/x-raw,format=Y444",
+			getVideoEncoder(settings),
+			"video/x-vp9,profile=(string)1",
+			"rtpvp9pay",
+		}
+	}
+
+	format := "I420"
+	if config.USE_NVIDIA {
+		format = "NV12"
+	}
+
+	return []string{
+		"videoconvert",
+		"video/x-raw,format=" + format,
+		getVideoEncoder(settings),
+		"h264parse config-interval=-1",
+		"video/x-h264,stream-format=byte-stream,profile=constrained-baseline",
+		"rtph264pay",
+	}
+}
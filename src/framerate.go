@@ -0,0 +1,120 @@
+package src
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/x11"
+)
+
+var (
+	// what gst-video is currently capturing at
+	framerate atomic.Int32
+
+	// unset if it cant be used here
+	adaptiveFramerate bool
+)
+
+func getFramerate() int {
+	return int(framerate.Load())
+}
+
+func setFramerate(value int) {
+	if framerate.Swap(int32(value)) == int32(value) {
+		return
+	}
+
+	slog.Info("framerate changed", "fps", value)
+
+	updatePipeline("gst-video", "rate", "max-rate", value)
+	updatePipeline("gst-video-fallback", "rate", "max-rate", value)
+}
+
+// key-int-max counts frames, so at the idle framerate a gop would last
+// seconds. keyframes are forced as often as they would be at the full rate
+func getKeyframeInterval() time.Duration {
+	settings := getStreamSettings()
+	return time.Duration(settings.GOP) * time.Second /
+		time.Duration(settings.Framerate)
+}
+
+func framerateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"framerate": getFramerate(),
+		"max":       getStreamSettings().Framerate,
+		"idle":      config.IDLE_FRAMERATE,
+		"adaptive":  adaptiveFramerate,
+	})
+}
+
+func watchDamage(damaged chan struct{}) {
+	for {
+		err := x11.WatchDamage(func() {
+			select {
+			case damaged <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			slog.Error("damage", "err", err.Error())
+		}
+		// display might not be ready yet
+		time.Sleep(time.Second * 5)
+	}
+}
+
+func initFramerate(httpMux *http.ServeMux) {
+	framerate.Store(int32(getStreamSettings().Framerate))
+
+	httpMux.HandleFunc("GET /api/framerate", adminOnly(framerateHandler))
+
+	if !config.ADAPTIVE_FRAMERATE || !config.IN_CONTAINER {
+		return
+	}
+
+	// every change would restart the encoder and viewers would stall
+	if !canControlPipelines {
+		slog.Warn("adaptive framerate needs in process gstreamer, ignoring")
+		return
+	}
+
+	adaptiveFramerate = true
+
+	slog.Info(
+		"using adaptive framerate",
+		"idle", config.IDLE_FRAMERATE, "timeout", config.IDLE_TIMEOUT,
+	)
+
+	damaged := make(chan struct{}, 1)
+	go watchDamage(damaged)
+
+	go func() {
+		idle := time.NewTimer(config.IDLE_TIMEOUT)
+
+		// only whilst idle
+		keyframes := time.NewTicker(time.Hour)
+		keyframes.Stop()
+
+		for {
+			select {
+			case <-damaged:
+				setFramerate(getStreamSettings().Framerate)
+				idle.Reset(config.IDLE_TIMEOUT)
+				keyframes.Stop()
+			case <-idle.C:
+				setFramerate(
+					min(config.IDLE_FRAMERATE, getStreamSettings().Framerate),
+				)
+				keyframes.Reset(getKeyframeInterval())
+			case <-keyframes.C:
+				requestKeyframe("gst-video")
+				requestKeyframe("gst-video-fallback")
+			}
+		}
+	}()
+}
@@ -0,0 +1,33 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func setTestStreamSettings(settings streamSettings) {
+	currentStreamSettingsMutex.Lock()
+	currentStreamSettings = settings
+	currentStreamSettingsMutex.Unlock()
+}
+
+func TestKeyframeIntervalIsFromFullFramerate(t *testing.T) {
+	old, oldFramerate := getStreamSettings(), getFramerate()
+	t.Cleanup(func() {
+		setTestStreamSettings(old)
+		framerate.Store(int32(oldFramerate))
+	})
+
+	settings := old
+	settings.Framerate = 60
+	settings.GOP = 120
+	setTestStreamSettings(settings)
+
+	// the idle framerate doesnt stretch it
+	framerate.Store(5)
+
+	interval := getKeyframeInterval()
+	if interval != 2*time.Second {
+		t.Errorf("expected 2s, got %s", interval)
+	}
+}
@@ -1,100 +1,381 @@
 package src
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/makinori/inu-desktop/src/config"
 	"github.com/makinori/inu-desktop/src/inuwebrtc"
-	"github.com/makinori/inu-desktop/src/supervisor"
+	"github.com/makinori/inu-desktop/src/inuws"
 )
 
-func initGStreamer() {
-	videoSrc := "ximagesrc use-damage=false"
-	audioSrc := "pulsesrc device=auto_null.monitor"
+type pipeline struct {
+	ID string
+	// gst-launch syntax, rebuilt on every start
+	GetElements func() []string
+	NoAutoStart bool
+	// send eos and wait for it when stopped, so muxers can finish the file
+	EOSOnStop bool
+}
 
-	if !config.IN_CONTAINER {
-		videoSrc = "videotestsrc"
-		audioSrc = "audiotestsrc freq=220"
+var (
+	errNotSupported = errors.New("not supported by this gstreamer backend")
+	errNotRunning   = errors.New("pipeline not running")
+)
+
+// how long eos has to reach the sinks
+const eosTimeout = time.Second * 5
+
+// changes the property live if possible, otherwise restarts the pipeline.
+// pipelines that aren't running will pick up the change when started
+func updatePipeline(id, element, property string, value any) {
+	err := setPipelineProperty(id, element, property, value)
+	if err == nil || errors.Is(err, errNotRunning) {
+		return
+	}
+
+	if !errors.Is(err, errNotSupported) {
+		slog.Warn(
+			"failed to set property, restarting", "id", id,
+			"property", property, "err", err.Error(),
+		)
 	}
 
-	// https://gstreamer.freedesktop.org/documentation/x264/index.html
-	videoEnc := "x264enc " +
-		"bitrate=6000 " +
-		"pass=cbr " +
-		"tune=zerolatency " +
-		"speed-preset=veryfast " +
-		fmt.Sprintf("key-int-max=%d", config.FRAMERATE)
+	// errors if not running which is fine
+	processes.Restart(id)
+}
 
-	if config.USE_NVIDIA {
-		// https://gstreamer.freedesktop.org/documentation/nvcodec/nvh264enc.html
-		videoEnc = "nvh264enc " +
-			"bitrate=6000 " +
-			"rc-mode=2 " + // CBR
-			"tune=3 " + // Ultra low latency
-			"multi-pass=2 " + // Two pass with quarter resolution
-			"preset=5 " + // Low Latency, High Performance
-			"zerolatency=true " +
-			// Number of frames between intra frames
-			fmt.Sprintf("gop-size=%d", config.FRAMERATE)
+type rtpStats struct {
+	Packets atomic.Uint64
+	Bytes   atomic.Uint64
+}
 
-		slog.Info("using nvidia for video encoding")
-	} else {
-		slog.Info("using cpu for video encoding")
+var (
+	// by rtp sink name, kept across restarts
+	rtpSinkStats      = map[string]*rtpStats{}
+	rtpSinkStatsMutex sync.RWMutex
+)
+
+// windows come and go, so they share one entry rather than one each forever
+func getRTPStatsName(sink string) string {
+	if strings.HasPrefix(sink, "gst-window-") {
+		return "window"
+	}
+	return sink
+}
+
+// used by the backends so stats are counted where packets are handed over
+func countRTP(sink string, write func([]byte)) func([]byte) {
+	name := getRTPStatsName(sink)
+
+	rtpSinkStatsMutex.Lock()
+	stats, exists := rtpSinkStats[name]
+	if !exists {
+		stats = &rtpStats{}
+		rtpSinkStats[name] = stats
+	}
+	rtpSinkStatsMutex.Unlock()
+
+	return func(packet []byte) {
+		stats.Packets.Add(1)
+		stats.Bytes.Add(uint64(len(packet)))
+		write(packet)
+	}
+}
+
+func pipelinesHandler(w http.ResponseWriter, r *http.Request) {
+	rtpSinkStatsMutex.RLock()
+	sinks := map[string]any{}
+	for name, stats := range rtpSinkStats {
+		sinks[name] = map[string]uint64{
+			"packets": stats.Packets.Load(),
+			"bytes":   stats.Bytes.Load(),
+		}
+	}
+	rtpSinkStatsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sinks)
+}
+
+// encoded rtp reused by other pipelines, so they dont need their own encode.
+// stream to appsrc name to writer
+var (
+	rtpTaps      = map[string]map[string]func([]byte){}
+	rtpTapsMutex sync.RWMutex
+)
+
+func tapRTP(stream string, source string) {
+	rtpTapsMutex.Lock()
+	defer rtpTapsMutex.Unlock()
+
+	if rtpTaps[stream] == nil {
+		rtpTaps[stream] = map[string]func([]byte){}
+	}
+	rtpTaps[stream][source] = rtpSourceWriter(source)
+}
+
+func untapRTP(stream string, source string) {
+	rtpTapsMutex.Lock()
+	defer rtpTapsMutex.Unlock()
+
+	delete(rtpTaps[stream], source)
+}
+
+func withRTPTaps(stream string, write func([]byte)) func([]byte) {
+	return func(packet []byte) {
+		write(packet)
+
+		rtpTapsMutex.RLock()
+		for _, tap := range rtpTaps[stream] {
+			tap(packet)
+		}
+		rtpTapsMutex.RUnlock()
+	}
+}
+
+// flv, mpeg-ts and hls players can only be expected to take h264
+func getH264VideoStream() string {
+	if getStreamSettings().getCodec() != codecH264 {
+		return "video-fallback"
+	}
+	return "video"
+}
+
+var (
+	// recordings and pushes that are running
+	pointerConsumers      int
+	pointerConsumersMutex sync.Mutex
+)
+
+// webrtc viewers have the cursor drawn by the browser, but recordings,
+// pushes, replays and hls only get the video. replay and hls are always on
+// when enabled so the pointer always is too
+func isPointerInVideo() bool {
+	return config.REPLAY || config.HLS || pointerConsumers > 0
+}
+
+// must be called with mutex locked
+func updatePointerInVideo() {
+	value := isPointerInVideo()
+
+	// so browsers dont draw a second one
+	inuws.SetPointerInVideo(value)
+
+	updatePipeline("gst-video", "screen", "show-pointer", value)
+	updatePipeline("gst-video-fallback", "screen", "show-pointer", value)
+}
+
+func acquirePointer() {
+	pointerConsumersMutex.Lock()
+	defer pointerConsumersMutex.Unlock()
+
+	pointerConsumers++
+	if pointerConsumers == 1 {
+		updatePointerInVideo()
+	}
+}
+
+func releasePointer() {
+	pointerConsumersMutex.Lock()
+	defer pointerConsumersMutex.Unlock()
+
+	pointerConsumers--
+	if pointerConsumers == 0 {
+		updatePointerInVideo()
 	}
+}
 
-	videoPipeline := []string{
+func getVideoSource(settings streamSettings) []string {
+	pointerConsumersMutex.Lock()
+	videoSrc := fmt.Sprintf(
+		"ximagesrc name=screen use-damage=false show-pointer=%t",
+		isPointerInVideo(),
+	)
+	pointerConsumersMutex.Unlock()
+
+	if !config.IN_CONTAINER {
+		videoSrc = "videotestsrc"
+	}
+
+	return []string{
 		videoSrc,
 		fmt.Sprintf(
-			"video/x-raw,width=%d,height=%d,framerate=%d/1", // ,format=NV12
-			config.SCREEN_WIDTH, config.SCREEN_HEIGHT, config.FRAMERATE,
+			"video/x-raw,width=%d,height=%d,framerate=%d/1",
+			config.SCREEN_WIDTH, config.SCREEN_HEIGHT, settings.Framerate,
+		),
+		// lowered by the adaptive framerate
+		fmt.Sprintf(
+			"videorate name=rate drop-only=true max-rate=%d", getFramerate(),
 		),
-		"videoconvert",
-		videoEnc,
-		"h264parse config-interval=-1",
-		"video/x-h264,stream-format=byte-stream,profile=constrained-baseline",
-		"rtph264pay",
-		fmt.Sprintf("udpsink host=127.0.0.1 port=%d", inuwebrtc.LocalRtpVideoPort),
 	}
+}
+
+func getVideoPipeline() []string {
+	settings := getStreamSettings()
+
+	elements := getVideoSource(settings)
+	elements = append(elements, getVideoEncoding(settings)...)
+
+	return append(elements, rtpSink(
+		"video", withRTPTaps("video", inuwebrtc.WriteVideoRTP),
+	))
+}
+
+func getFallbackVideoPipeline() []string {
+	settings := getStreamSettings().getFallback()
+
+	elements := getVideoSource(settings)
+	elements = append(elements, getVideoEncoding(settings)...)
+
+	return append(elements, rtpSink(
+		"video-fallback",
+		withRTPTaps("video-fallback", inuwebrtc.WriteFallbackVideoRTP),
+	))
+}
+
+func getAudioPipeline() []string {
+	audioSrc := "pulsesrc server=" + pulseServer + " device=auto_null.monitor"
+
+	if !config.IN_CONTAINER {
+		audioSrc = "audiotestsrc freq=220"
+	}
+
+	// TODO: set PULSE_LATENCY_MSEC really low?
 
 	// https://wiki.xiph.org/Opus_Recommended_Settings
-	audioPipeline := []string{
+	return []string{
 		audioSrc,
 		"audioconvert",
-		"opusenc bitrate=320000",
+		fmt.Sprintf(
+			"opusenc name=encoder bitrate=%d",
+			getStreamSettings().AudioBitrate,
+		),
 		"rtpopuspay",
-		fmt.Sprintf("udpsink host=127.0.0.1 port=%d", inuwebrtc.LocalRtpAudioPort),
+		rtpSink("audio", withRTPTaps("audio", inuwebrtc.WriteAudioRTP)),
 	}
+}
 
-	videoCommand := "gst-launch-1.0 --no-position " +
-		strings.Join(videoPipeline, " ! ")
+func getMicPipeline() []string {
+	// browser microphone into the pulseaudio pipe source
+	micSink := fmt.Sprintf(
+		"audio/x-raw,format=S16LE,rate=%d,channels=%d ! "+
+			"filesink location=%s buffer-mode=unbuffered sync=false",
+		micRate, micChannels, micPipePath,
+	)
+
+	if !config.IN_CONTAINER {
+		micSink = "autoaudiosink"
+	}
 
-	audioCommand := "gst-launch-1.0 --no-position " +
-		strings.Join(audioPipeline, " ! ")
+	return []string{
+		rtpSource("mic", fmt.Sprintf(
+			"application/x-rtp,media=audio,clock-rate=48000,"+
+				"encoding-name=OPUS,payload=%d",
+			inuwebrtc.MicPayloadType,
+		)),
+		"rtpjitterbuffer latency=40",
+		"rtpopusdepay",
+		"opusdec",
+		"audioconvert",
+		"audioresample",
+		micSink,
+	}
+}
 
-	// TODO: set PULSE_LATENCY_MSEC really low?
+var (
+	lastKeyframes      = map[string]time.Time{}
+	lastKeyframesMutex sync.Mutex
+)
 
-	processes.AddCommand(supervisor.Command{
-		ID:          "gst-video",
-		Command:     "sh",
-		Args:        []string{"-c", videoCommand},
-		NoAutoStart: true,
+// several viewers joining or losing packets at once only need one
+func requestKeyframe(id string) {
+	lastKeyframesMutex.Lock()
+	if time.Since(lastKeyframes[id]) < time.Millisecond*500 {
+		lastKeyframesMutex.Unlock()
+		return
+	}
+	lastKeyframes[id] = time.Now()
+	lastKeyframesMutex.Unlock()
+
+	err := forceKeyframe(id)
+	if err != nil && !errors.Is(err, errNotRunning) &&
+		!errors.Is(err, errNotSupported) {
+		slog.Warn("failed to force keyframe", "id", id, "err", err.Error())
+	}
+}
+
+// for pipelines that just started using the rtp,
+// otherwise they wait for the next keyframe
+func requestKeyframeSoon(id string) {
+	time.AfterFunc(time.Second, func() {
+		requestKeyframe(id)
 	})
+}
+
+func onKeyframeRequest(request inuwebrtc.KeyframeRequest) {
+	switch {
+	case request.XID != 0:
+		requestKeyframe(getWindowProcessID(request.XID))
+	case request.Fallback:
+		requestKeyframe("gst-video-fallback")
+	default:
+		requestKeyframe("gst-video")
+	}
+}
+
+func initGStreamer(httpMux *http.ServeMux) {
+	initGStreamerBackend()
 
-	if config.IN_CONTAINER {
-		processes.AddCommand(supervisor.Command{
-			ID:          "gst-audio",
-			Command:     "su",
-			Args:        []string{"inu", "-c", audioCommand},
-			NoAutoStart: true,
-		})
+	httpMux.HandleFunc("GET /api/pipelines", adminOnly(pipelinesHandler))
+
+	if config.USE_NVIDIA {
+		slog.Info("using nvidia for video encoding")
 	} else {
-		processes.AddCommand(supervisor.Command{
-			ID:          "gst-audio",
-			Command:     "sh",
-			Args:        []string{"-c", audioCommand},
-			NoAutoStart: true,
-		})
+		slog.Info("using cpu for video encoding")
 	}
+
+	setWebRTCCodec(getStreamSettings().getCodec())
+
+	inuws.SetPointerInVideo(isPointerInVideo())
+
+	addPipeline(pipeline{
+		ID:          "gst-video",
+		GetElements: getVideoPipeline,
+		NoAutoStart: true,
+	})
+
+	addPipeline(pipeline{
+		ID:          "gst-video-fallback",
+		GetElements: getFallbackVideoPipeline,
+		NoAutoStart: true,
+	})
+
+	addPipeline(pipeline{
+		ID:          "gst-audio",
+		GetElements: getAudioPipeline,
+		NoAutoStart: true,
+	})
+
+	addPipeline(pipeline{
+		ID:          "gst-mic",
+		GetElements: getMicPipeline,
+		NoAutoStart: true,
+	})
+
+	inuwebrtc.SetMicWriter(rtpSourceWriter("mic"))
+
+	inuwebrtc.KeyframeRequestSignal.AddListener(
+		func(ctx context.Context, request inuwebrtc.KeyframeRequest) {
+			onKeyframeRequest(request)
+		},
+	)
 }
@@ -0,0 +1,305 @@
+//go:build !gstlaunch
+
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+	"github.com/go-gst/go-gst/gst/app"
+	"github.com/makinori/inu-desktop/src/supervisor"
+)
+
+// runs pipelines with gstreamer bindings. rtp is handed over with
+// appsink and appsrc so there's no copy through a local socket
+
+const canControlPipelines = true
+
+var (
+	runningPipelines      = map[string]*gst.Pipeline{}
+	runningPipelinesMutex sync.RWMutex
+
+	rtpSinks      = map[string]func([]byte){}
+	rtpSinksMutex sync.RWMutex
+
+	// appsrc by name, only set whilst its pipeline is running
+	rtpSources      = map[string]*app.Source{}
+	rtpSourcesMutex sync.RWMutex
+)
+
+func initGStreamerBackend() {
+	gst.Init(nil)
+	slog.Info("using gstreamer in process for pipelines")
+}
+
+func rtpSink(name string, write func([]byte)) string {
+	rtpSinksMutex.Lock()
+	rtpSinks[name] = countRTP(name, write)
+	rtpSinksMutex.Unlock()
+
+	return fmt.Sprintf(
+		"appsink name=%s sync=false max-buffers=300 drop=true", name,
+	)
+}
+
+func releaseRTPSink(name string) {
+	rtpSinksMutex.Lock()
+	delete(rtpSinks, name)
+	rtpSinksMutex.Unlock()
+}
+
+func rtpSource(name string, caps string) string {
+	return fmt.Sprintf(
+		"appsrc name=%s is-live=true format=time do-timestamp=true "+
+			"max-bytes=300000 caps=\"%s\"",
+		name, caps,
+	)
+}
+
+func rtpSourceWriter(name string) func([]byte) {
+	return func(packet []byte) {
+		rtpSourcesMutex.RLock()
+		source, exists := rtpSources[name]
+		rtpSourcesMutex.RUnlock()
+
+		if !exists {
+			return
+		}
+
+		// copied into the buffer
+		source.PushBuffer(gst.NewBufferFromBytes(packet))
+	}
+}
+
+func connectRTPSinks(pipeline *gst.Pipeline) {
+	rtpSinksMutex.RLock()
+	defer rtpSinksMutex.RUnlock()
+
+	for name, write := range rtpSinks {
+		element, err := pipeline.GetElementByName(name)
+		if err != nil {
+			continue
+		}
+
+		app.SinkFromElement(element).SetCallbacks(&app.SinkCallbacks{
+			NewSampleFunc: func(sink *app.Sink) gst.FlowReturn {
+				sample := sink.PullSample()
+				if sample == nil {
+					return gst.FlowEOS
+				}
+
+				buffer := sample.GetBuffer()
+				if buffer == nil {
+					return gst.FlowError
+				}
+
+				write(buffer.Bytes())
+
+				return gst.FlowOK
+			},
+		})
+	}
+}
+
+// returns the appsrc names that were connected
+func connectRTPSources(pipeline *gst.Pipeline, names []string) []string {
+	rtpSourcesMutex.Lock()
+	defer rtpSourcesMutex.Unlock()
+
+	var connected []string
+
+	for _, name := range names {
+		element, err := pipeline.GetElementByName(name)
+		if err != nil {
+			continue
+		}
+
+		rtpSources[name] = app.SrcFromElement(element)
+		connected = append(connected, name)
+	}
+
+	return connected
+}
+
+func disconnectRTPSources(names []string) {
+	rtpSourcesMutex.Lock()
+	defer rtpSourcesMutex.Unlock()
+
+	for _, name := range names {
+		delete(rtpSources, name)
+	}
+}
+
+// elements can have more than one branch, so look at every appsrc
+func getSourceNames(elements []string) []string {
+	var names []string
+	inSource := false
+	for _, field := range strings.Fields(strings.Join(elements, " ! ")) {
+		switch {
+		case field == "appsrc":
+			inSource = true
+		case field == "!":
+			inSource = false
+		case inSource:
+			name, found := strings.CutPrefix(field, "name=")
+			if found {
+				names = append(names, name)
+				inSource = false
+			}
+		}
+	}
+	return names
+}
+
+// waits for eos to reach the sinks
+func drainPipeline(id string, pipeline *gst.Pipeline) {
+	pipeline.SendEvent(gst.NewEOSEvent())
+
+	bus := pipeline.GetPipelineBus()
+	deadline := time.Now().Add(eosTimeout)
+
+	for time.Now().Before(deadline) {
+		message := bus.TimedPop(gst.ClockTime(100 * time.Millisecond))
+		if message == nil {
+			continue
+		}
+
+		switch message.Type() {
+		case gst.MessageEOS:
+			return
+		case gst.MessageError:
+			slog.Warn(id, "err", message.ParseError().Error())
+			return
+		}
+	}
+
+	slog.Warn(id + " didnt finish in time")
+}
+
+func runPipeline(
+	ctx context.Context, id string, elements []string, eosOnStop bool,
+) error {
+	pipeline, err := gst.NewPipelineFromString(strings.Join(elements, " ! "))
+	if err != nil {
+		return err
+	}
+
+	connectRTPSinks(pipeline)
+
+	sources := connectRTPSources(pipeline, getSourceNames(elements))
+	defer disconnectRTPSources(sources)
+
+	err = pipeline.SetState(gst.StatePlaying)
+	if err != nil {
+		pipeline.SetState(gst.StateNull)
+		return err
+	}
+
+	runningPipelinesMutex.Lock()
+	runningPipelines[id] = pipeline
+	runningPipelinesMutex.Unlock()
+
+	defer func() {
+		runningPipelinesMutex.Lock()
+		delete(runningPipelines, id)
+		runningPipelinesMutex.Unlock()
+
+		pipeline.SetState(gst.StateNull)
+	}()
+
+	bus := pipeline.GetPipelineBus()
+
+	for ctx.Err() == nil {
+		message := bus.TimedPop(gst.ClockTime(100 * time.Millisecond))
+		if message == nil {
+			continue
+		}
+
+		switch message.Type() {
+		case gst.MessageEOS:
+			return nil
+
+		case gst.MessageError:
+			gerr := message.ParseError()
+			slog.Debug(id, "debug", gerr.DebugString())
+			return gerr
+
+		case gst.MessageWarning:
+			slog.Warn(id, "warn", message.ParseWarning().Error())
+		}
+	}
+
+	if eosOnStop {
+		drainPipeline(id, pipeline)
+	}
+
+	return nil
+}
+
+// for pipelines that end by themselves, like remuxing a file
+func runPipelineOnce(ctx context.Context, id string, elements []string) error {
+	return runPipeline(ctx, id, elements, false)
+}
+
+func addPipeline(p pipeline) {
+	processes.AddFunc(supervisor.Func{
+		ID: p.ID,
+		Run: func(ctx context.Context) error {
+			return runPipeline(ctx, p.ID, p.GetElements(), p.EOSOnStop)
+		},
+		NoAutoStart: p.NoAutoStart,
+	})
+}
+
+func setPipelineProperty(id, element, property string, value any) error {
+	runningPipelinesMutex.RLock()
+	pipeline, exists := runningPipelines[id]
+	runningPipelinesMutex.RUnlock()
+
+	if !exists {
+		return errNotRunning
+	}
+
+	target, err := pipeline.GetElementByName(element)
+	if err != nil {
+		return err
+	}
+
+	// parses the same way as gst-launch
+	target.SetArg(property, fmt.Sprint(value))
+
+	return nil
+}
+
+func forceKeyframe(id string) error {
+	runningPipelinesMutex.RLock()
+	pipeline, exists := runningPipelines[id]
+	runningPipelinesMutex.RUnlock()
+
+	if !exists {
+		return errNotRunning
+	}
+
+	encoder, err := pipeline.GetElementByName("encoder")
+	if err != nil {
+		return err
+	}
+
+	// same as gst_video_event_new_upstream_force_key_unit
+	event := gst.NewCustomEvent(
+		gst.EventTypeCustomUpstream,
+		gst.NewStructureFromString("GstForceKeyUnit, all-headers=(boolean)true"),
+	)
+
+	if !encoder.GetStaticPad("src").SendEvent(event) {
+		return errors.New("encoder didnt accept keyframe request")
+	}
+
+	return nil
+}
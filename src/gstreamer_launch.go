@@ -0,0 +1,212 @@
+//go:build gstlaunch
+
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/supervisor"
+)
+
+// fallback which runs gst-launch and sends rtp over localhost udp
+
+// running pipelines cant be changed or sent events, only restarted
+const canControlPipelines = false
+
+var (
+	rtpSinks      = map[string]*net.UDPConn{}
+	rtpSinksMutex sync.Mutex
+
+	rtpSources      = map[string]*net.UDPConn{}
+	rtpSourcesMutex sync.Mutex
+)
+
+func initGStreamerBackend() {
+	slog.Info("using gst-launch for pipelines")
+}
+
+func listenLocalUDP() (*net.UDPConn, error) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP: net.ParseIP("127.0.0.1"), Port: 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bufferSize := 300000 // 300KB
+	err = l.SetReadBuffer(bufferSize)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// returns once the listener is closed
+func udpServerForRTP(l *net.UDPConn, write func([]byte)) {
+	packet := make([]byte, 1600)
+	for {
+		n, _, err := l.ReadFrom(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("rtp read error", "err", err)
+			continue
+		}
+
+		write(packet[:n])
+	}
+}
+
+func rtpSink(name string, write func([]byte)) string {
+	rtpSinksMutex.Lock()
+	defer rtpSinksMutex.Unlock()
+
+	l, exists := rtpSinks[name]
+	if !exists {
+		var err error
+		l, err = listenLocalUDP()
+		if err != nil {
+			panic(err)
+		}
+
+		rtpSinks[name] = l
+
+		slog.Info(
+			"local rtp listening", "name", name,
+			"port", l.LocalAddr().(*net.UDPAddr).Port,
+		)
+
+		go udpServerForRTP(l, countRTP(name, write))
+	}
+
+	return fmt.Sprintf(
+		"udpsink host=127.0.0.1 port=%d", l.LocalAddr().(*net.UDPAddr).Port,
+	)
+}
+
+func releaseRTPSink(name string) {
+	rtpSinksMutex.Lock()
+	defer rtpSinksMutex.Unlock()
+
+	l, exists := rtpSinks[name]
+	if !exists {
+		return
+	}
+
+	l.Close()
+	delete(rtpSinks, name)
+}
+
+func getRTPSource(name string) *net.UDPConn {
+	rtpSourcesMutex.Lock()
+	defer rtpSourcesMutex.Unlock()
+
+	conn, exists := rtpSources[name]
+	if exists {
+		return conn
+	}
+
+	port, err := getFreeUDPPort()
+	if err != nil {
+		panic(err)
+	}
+
+	conn, err = net.DialUDP("udp", nil, &net.UDPAddr{
+		IP: net.ParseIP("127.0.0.1"), Port: port,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	rtpSources[name] = conn
+
+	slog.Info("local rtp sending", "name", name, "port", port)
+
+	return conn
+}
+
+func rtpSource(name string, caps string) string {
+	conn := getRTPSource(name)
+	return fmt.Sprintf(
+		"udpsrc address=127.0.0.1 port=%d caps=\"%s\"",
+		conn.RemoteAddr().(*net.UDPAddr).Port, caps,
+	)
+}
+
+func rtpSourceWriter(name string) func([]byte) {
+	conn := getRTPSource(name)
+	return func(packet []byte) {
+		// errors when the pipeline isnt running which is fine
+		conn.Write(packet)
+	}
+}
+
+func addPipeline(p pipeline) {
+	flags := "--no-position "
+	var gracefulStop time.Duration
+	if p.EOSOnStop {
+		// sends eos when interrupted
+		flags += "-e "
+		gracefulStop = eosTimeout
+	}
+
+	processes.AddCommand(supervisor.Command{
+		ID:      p.ID,
+		Command: "sh",
+		GetArgs: func() []string {
+			// exec so signals reach gst-launch
+			return []string{"-c", "exec gst-launch-1.0 " + flags +
+				strings.Join(p.GetElements(), " ! ")}
+		},
+		NoAutoStart:  p.NoAutoStart,
+		GracefulStop: gracefulStop,
+	})
+}
+
+// for pipelines that end by themselves, like remuxing a file
+func runPipelineOnce(ctx context.Context, id string, elements []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c",
+		"exec gst-launch-1.0 --no-position "+strings.Join(elements, " ! "),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", id, err, output)
+	}
+	return nil
+}
+
+// gst-launch cant be changed whilst running
+func setPipelineProperty(id, element, property string, value any) error {
+	return errNotSupported
+}
+
+func getFreeUDPPort() (int, error) {
+	addr, err := net.ResolveUDPAddr("udp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+
+	l, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// no way to send events into gst-launch
+func forceKeyframe(id string) error {
+	return errNotSupported
+}
@@ -0,0 +1,129 @@
+package src
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/supervisor"
+)
+
+var startPipelinesOnce sync.Once
+
+// test sources instead of the desktop, with pipelines stopped
+// as soon as they're released
+func startTestPipelines(t *testing.T) {
+	t.Helper()
+
+	_, err := exec.LookPath("gst-launch-1.0")
+	if err != nil {
+		t.Skip("gstreamer isnt installed")
+	}
+
+	startPipelinesOnce.Do(func() {
+		config.IN_CONTAINER = false
+		config.PIPELINE_LINGER = 0
+		// outlives the test that started them
+		config.DATA_DIR, err = os.MkdirTemp("", "inu-test-*")
+		if err != nil {
+			panic(err)
+		}
+
+		currentStreamSettings = getDefaultStreamSettings()
+
+		httpMux := http.NewServeMux()
+		initGStreamer(httpMux)
+		initPush(httpMux)
+		initRecordings(httpMux)
+
+		go processes.Run()
+	})
+}
+
+func getFreeLocalPort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.LocalAddr().(*net.UDPAddr).Port
+}
+
+// gst-launch as a stand in for whatever's on the other end
+func startGStreamer(t *testing.T, elements string) {
+	t.Helper()
+
+	cmd := exec.Command("sh", "-c", "exec gst-launch-1.0 -q "+elements)
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+}
+
+// size of a file once it's grown past at least
+func waitForFileSize(t *testing.T, path string, atLeast int64) int64 {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		info, err := os.Stat(path)
+		if err == nil && info.Size() > atLeast {
+			return info.Size()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("%s never grew past %d bytes", path, atLeast)
+	return 0
+}
+
+func TestPointerInVideoWhilstRecording(t *testing.T) {
+	if processes == nil {
+		processes = supervisor.New()
+	}
+
+	defaultContainer := config.IN_CONTAINER
+	defaultReplay, defaultHLS := config.REPLAY, config.HLS
+	t.Cleanup(func() {
+		config.IN_CONTAINER = defaultContainer
+		config.REPLAY, config.HLS = defaultReplay, defaultHLS
+	})
+	config.IN_CONTAINER = true
+	config.REPLAY, config.HLS = false, false
+
+	getShowPointer := func() string {
+		return getVideoSource(getDefaultStreamSettings())[0]
+	}
+
+	if strings.Contains(getShowPointer(), "show-pointer=true") {
+		t.Fatal("pointer in the video with only webrtc")
+	}
+
+	acquirePointer()
+	acquirePointer()
+	releasePointer()
+
+	if !strings.Contains(getShowPointer(), "show-pointer=true") {
+		t.Error("pointer not in the video whilst recording")
+	}
+
+	releasePointer()
+
+	if strings.Contains(getShowPointer(), "show-pointer=true") {
+		t.Error("pointer still in the video after recording")
+	}
+}
@@ -0,0 +1,217 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+)
+
+// fmp4 segments written by hlscmafsink from the webrtc encode, which does
+// one stream per sink, so audio is its own rendition. ll-hls is out of
+// scope, hlscmafsink cant write partial segments
+
+const hlsDir = "/tmp/inu-hls"
+
+var (
+	// which video stream is being tapped
+	hlsVideo      string
+	hlsVideoMutex sync.Mutex
+)
+
+func getHLSSink(stream string) string {
+	dir := filepath.Join(hlsDir, stream)
+	return "hlscmafsink " +
+		"location=" + dir + "/segment%05d.m4s " +
+		"init-location=" + dir + "/init%05d.mp4 " +
+		"playlist-location=" + dir + "/playlist.m3u8 " +
+		fmt.Sprintf(
+			"target-duration=%d ",
+			max(int(config.HLS_SEGMENT_DURATION.Seconds()), 1),
+		) +
+		fmt.Sprintf("playlist-length=%d ", config.HLS_PLAYLIST_LENGTH) +
+		fmt.Sprintf("max-files=%d", config.HLS_PLAYLIST_LENGTH*2)
+}
+
+// segments from the last run would be served as if they were new
+func resetHLSDir() {
+	os.RemoveAll(hlsDir)
+
+	for _, stream := range []string{"video", "audio"} {
+		err := os.MkdirAll(filepath.Join(hlsDir, stream), 0755)
+		if err != nil {
+			slog.Error("failed to create hls dir", "err", err.Error())
+		}
+	}
+}
+
+// encodes being tapped have to run whilst players are fetching
+func holdHLSPipelines() {
+	holdPipeline("gst-hls", config.HLS_IDLE_TIMEOUT)
+	holdPipeline("gst-"+getH264VideoStream(), config.HLS_IDLE_TIMEOUT)
+	holdPipeline("gst-audio", config.HLS_IDLE_TIMEOUT)
+}
+
+func getHLSPipeline() []string {
+	resetHLSDir()
+
+	// the codec might have changed since the last start
+	video := getH264VideoStream()
+
+	hlsVideoMutex.Lock()
+	if video != hlsVideo {
+		if hlsVideo != "" {
+			untapRTP(hlsVideo, "hls-video")
+		}
+		tapRTP(video, "hls-video")
+		hlsVideo = video
+	}
+	hlsVideoMutex.Unlock()
+
+	// segments can only start on one
+	requestKeyframeSoon("gst-" + video)
+
+	// flac and opus in fmp4 arent widely played
+	audio := strings.Join([]string{
+		rtpSource("hls-audio",
+			"application/x-rtp,media=audio,clock-rate=48000,encoding-name=OPUS",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtpopusdepay",
+		"opusdec",
+		"audioconvert",
+		"audioresample",
+		fmt.Sprintf(
+			"avenc_aac bitrate=%d", getStreamSettings().AudioBitrate,
+		),
+		"aacparse",
+		getHLSSink("audio"),
+	}, " ! ")
+
+	return []string{
+		rtpSource("hls-video",
+			"application/x-rtp,media=video,clock-rate=90000,encoding-name=H264",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtph264depay",
+		"h264parse",
+		"video/x-h264,stream-format=avc,alignment=au",
+		getHLSSink("video") + " " + audio,
+	}
+}
+
+// intra refresh never has a keyframe to start a segment on
+func forceHLSKeyframes() {
+	for range time.Tick(config.HLS_SEGMENT_DURATION) {
+		profile, _ := getQualityProfile(getStreamSettings().Profile)
+		if !profile.IntraRefresh || !isControlledPipelineRunning("gst-hls") {
+			continue
+		}
+
+		hlsVideoMutex.Lock()
+		video := hlsVideo
+		hlsVideoMutex.Unlock()
+
+		requestKeyframe("gst-" + video)
+	}
+}
+
+func getHLSMultivariantPlaylist() string {
+	settings := getStreamSettings()
+
+	bandwidth := settings.VideoBitrate*1000 + settings.AudioBitrate
+
+	// the encode is constrained baseline, level 5.1 so any resolution fits
+	return "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="desktop",` +
+		`DEFAULT=YES,AUTOSELECT=YES,URI="audio/playlist.m3u8"` + "\n" +
+		fmt.Sprintf(
+			`#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS="avc1.42e033,mp4a.40.2",`+
+				`RESOLUTION=%dx%d,FRAME-RATE=%d,AUDIO="audio"`+"\n",
+			bandwidth, config.SCREEN_WIDTH, config.SCREEN_HEIGHT,
+			settings.Framerate,
+		) +
+		"video/playlist.m3u8\n"
+}
+
+// the pipeline is started on the first request,
+// so wait for the sink to write the playlist
+func waitForHLSFile(path string) bool {
+	deadline := time.Now().Add(
+		config.HLS_SEGMENT_DURATION*2 + time.Second*5,
+	)
+
+	for time.Now().Before(deadline) {
+		_, err := os.Stat(path)
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return false
+}
+
+func hlsHandler() http.Handler {
+	fileServer := http.StripPrefix("/hls/", http.FileServer(http.Dir(hlsDir)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		holdHLSPipelines()
+
+		path := strings.TrimPrefix(r.URL.Path, "/hls/")
+
+		if path == "" || path == "index.m3u8" {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+			fmt.Fprint(w, getHLSMultivariantPlaylist())
+			return
+		}
+
+		if strings.HasSuffix(path, ".m3u8") {
+			if !waitForHLSFile(filepath.Join(hlsDir, filepath.Clean("/"+path))) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "stream starting", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		}
+
+		// segment numbers are reused when the pipeline restarts
+		w.Header().Set("Cache-Control", "no-cache")
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+func initHLS(httpMux *http.ServeMux) {
+	if !config.HLS {
+		return
+	}
+
+	addPipeline(pipeline{
+		ID:          "gst-hls",
+		GetElements: getHLSPipeline,
+		NoAutoStart: true,
+	})
+
+	addControlledPipeline("gst-hls")
+
+	tapRTP("audio", "hls-audio")
+
+	go forceHLSKeyframes()
+
+	httpMux.Handle("GET /hls/", hlsHandler())
+}
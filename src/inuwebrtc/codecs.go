@@ -0,0 +1,194 @@
+package inuwebrtc
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// browsers wont offer codecs they cant decode,
+// so only capable viewers get the full chroma ones
+
+var (
+	// 4:2:0, everything supports this
+	CodecH264 = webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeH264,
+		ClockRate: 90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;" +
+			"profile-level-id=42e01f",
+	}
+
+	// 4:4:4
+	CodecH264High444 = webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeH264,
+		ClockRate: 90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;" +
+			"profile-level-id=f4001f",
+	}
+
+	// 4:4:4
+	CodecVP9Profile1 = webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeVP9,
+		ClockRate:   90000,
+		SDPFmtpLine: "profile-id=1",
+	}
+
+	videoCodecs = []webrtc.RTPCodecCapability{
+		CodecH264, CodecH264High444, CodecVP9Profile1,
+	}
+)
+
+func sameCodec(a, b webrtc.RTPCodecCapability) bool {
+	return strings.EqualFold(a.MimeType, b.MimeType) &&
+		a.SDPFmtpLine == b.SDPFmtpLine
+}
+
+func registerVideoCodecs(mediaEngine *webrtc.MediaEngine) error {
+	for i, codec := range videoCodecs {
+		// so browsers ask for keyframes when they cant decode
+		codec.RTCPFeedback = []webrtc.RTCPFeedback{
+			{Type: "nack", Parameter: "pli"},
+			{Type: "ccm", Parameter: "fir"},
+		}
+
+		err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: codec,
+			PayloadType:        webrtc.PayloadType(96 + i),
+		}, webrtc.RTPCodecTypeVideo)
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseFmtp(line string) map[string]string {
+	params := map[string]string{}
+	for _, param := range strings.Split(line, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[strings.ToLower(key)] = value
+	}
+	return params
+}
+
+// same rules pion uses when matching codecs
+func fmtpMatches(mimeType string, a string, b string) bool {
+	aParams, bParams := parseFmtp(a), parseFmtp(b)
+
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		if aParams["packetization-mode"] != bParams["packetization-mode"] {
+			return false
+		}
+
+		// profile_idc and profile_iop, level doesnt matter
+		aID, err := hex.DecodeString(aParams["profile-level-id"])
+		if err != nil || len(aID) < 2 {
+			return false
+		}
+		bID, err := hex.DecodeString(bParams["profile-level-id"])
+		if err != nil || len(bID) < 2 {
+			return false
+		}
+
+		return aID[0] == bID[0] && aID[1] == bID[1]
+
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		aProfile, bProfile := aParams["profile-id"], bParams["profile-id"]
+		if aProfile == "" {
+			aProfile = "0"
+		}
+		if bProfile == "" {
+			bProfile = "0"
+		}
+		return aProfile == bProfile
+	}
+
+	return true
+}
+
+func offerSupports(offer []byte, codec webrtc.RTPCodecCapability) bool {
+	var description sdp.SessionDescription
+	err := description.Unmarshal(offer)
+	if err != nil {
+		return false
+	}
+
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+
+			offered, err := description.GetCodecForPayloadType(
+				uint8(payloadType),
+			)
+			if err != nil {
+				continue
+			}
+
+			if !strings.EqualFold("video/"+offered.Name, codec.MimeType) {
+				continue
+			}
+
+			if fmtpMatches(codec.MimeType, offered.Fmtp, codec.SDPFmtpLine) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// if the rtp payload starts a frame that can be decoded on its own
+func isKeyframeStart(mimeType string, payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		// https://datatracker.ietf.org/doc/html/rfc6184#section-5.2
+		const (
+			naluIDR   = 5
+			naluSPS   = 7
+			naluSTAPA = 24
+			naluFUA   = 28
+		)
+
+		switch payload[0] & 0x1f {
+		case naluIDR, naluSPS:
+			return true
+
+		case naluSTAPA:
+			for i := 1; i+2 < len(payload); {
+				size := int(payload[i])<<8 | int(payload[i+1])
+				naluType := payload[i+2] & 0x1f
+				if naluType == naluIDR || naluType == naluSPS {
+					return true
+				}
+				i += 2 + size
+			}
+
+		case naluFUA:
+			start := payload[1]&0x80 != 0
+			return start && payload[1]&0x1f == naluIDR
+		}
+
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		// https://datatracker.ietf.org/doc/html/rfc9628#section-4.2
+		// start of frame and not inter predicted
+		return payload[0]&0x08 != 0 && payload[0]&0x40 == 0
+	}
+
+	return false
+}
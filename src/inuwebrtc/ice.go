@@ -0,0 +1,222 @@
+package inuwebrtc
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// which local addresses candidates are made from and what they're
+// advertised as. same rules as pion's nat 1 to 1 so the logs are right
+
+type natMapping struct {
+	external net.IP
+	// nil when every local address of the family is advertised as external
+	local net.IP
+}
+
+var (
+	natMappings []natMapping
+
+	// what ice is listening on, the only ports turn relays to
+	icePorts []int
+
+	errInvalidNATMapping = errors.New(
+		"PUBLIC_IP must be comma separated ips or external/local ip pairs",
+	)
+)
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+func parseNATMappings(values []string) ([]natMapping, error) {
+	var mappings []natMapping
+
+	for _, value := range values {
+		// TODO: use dns??
+		externalStr, localStr, hasLocal := strings.Cut(value, "/")
+
+		mapping := natMapping{external: net.ParseIP(externalStr)}
+		if mapping.external == nil {
+			return nil, errInvalidNATMapping
+		}
+
+		if hasLocal {
+			mapping.local = net.ParseIP(localStr)
+			if mapping.local == nil ||
+				isIPv4(mapping.local) != isIPv4(mapping.external) {
+				return nil, errInvalidNATMapping
+			}
+		}
+
+		// a family either has one external for everything or only pairs
+		for _, other := range mappings {
+			if isIPv4(other.external) != isIPv4(mapping.external) {
+				continue
+			}
+			if other.local == nil || mapping.local == nil ||
+				other.local.Equal(mapping.local) {
+				return nil, errInvalidNATMapping
+			}
+		}
+
+		mappings = append(mappings, mapping)
+	}
+
+	return mappings, nil
+}
+
+// false if there's pairs for the family but none for this address
+func mapLocalIP(ip net.IP) (net.IP, bool) {
+	found := false
+
+	for _, mapping := range natMappings {
+		if isIPv4(mapping.external) != isIPv4(ip) {
+			continue
+		}
+		found = true
+
+		if mapping.local == nil || mapping.local.Equal(ip) {
+			return mapping.external, true
+		}
+	}
+
+	// advertised as is, if there's nothing for the family
+	return ip, !found
+}
+
+func isICEInterfaceAllowed(name string) bool {
+	return len(config.ICE_INTERFACES) == 0 ||
+		slices.Contains(config.ICE_INTERFACES, name)
+}
+
+func isICEAddressAllowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+
+	if len(config.ICE_ADDRESSES) > 0 && !slices.ContainsFunc(
+		config.ICE_ADDRESSES, func(address string) bool {
+			return ip.Equal(net.ParseIP(address))
+		},
+	) {
+		return false
+	}
+
+	_, ok := mapLocalIP(ip)
+	return ok
+}
+
+// what ice-tcp candidates will be made from
+func getICELocalAddresses() []net.IP {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || !isICEInterfaceAllowed(iface.Name) {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !isICEAddressAllowed(ipNet.IP) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	return ips
+}
+
+func logICECandidate(network string, local net.IP, port int) {
+	external, _ := mapLocalIP(local)
+	slog.Info(
+		"ice candidate",
+		"network", network,
+		"local", net.JoinHostPort(local.String(), strconv.Itoa(port)),
+		"advertised", net.JoinHostPort(external.String(), strconv.Itoa(port)),
+	)
+}
+
+func setupICE(settingEngine *webrtc.SettingEngine) {
+	var err error
+	natMappings, err = parseNATMappings(config.PUBLIC_IP)
+	if err != nil {
+		panic(err)
+	}
+
+	udpMux, err := ice.NewMultiUDPMuxFromPort(
+		config.UDP_PORT,
+		ice.UDPMuxFromPortWithInterfaceFilter(isICEInterfaceAllowed),
+		ice.UDPMuxFromPortWithIPFilter(isICEAddressAllowed),
+	)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("public udp listening at " + strconv.Itoa(config.UDP_PORT))
+
+	for _, addr := range udpMux.GetListenAddresses() {
+		udpAddr := addr.(*net.UDPAddr)
+		logICECandidate("udp", udpAddr.IP, udpAddr.Port)
+		icePorts = append(icePorts, udpAddr.Port)
+	}
+
+	settingEngine.SetLite(true)
+	settingEngine.SetICEUDPMux(udpMux)
+	settingEngine.SetIncludeLoopbackCandidate(false)
+	// udp candidates come from the mux instead
+	settingEngine.SetInterfaceFilter(func(s string) (keep bool) {
+		return false
+	})
+
+	networkTypes := []webrtc.NetworkType{
+		webrtc.NetworkTypeUDP4,
+		webrtc.NetworkTypeUDP6,
+	}
+
+	if config.TCP_PORT != 0 {
+		setupICETCP(settingEngine)
+
+		// tcp candidates come from the interfaces rather than the mux
+		settingEngine.SetInterfaceFilter(isICEInterfaceAllowed)
+		settingEngine.SetIPFilter(isICEAddressAllowed)
+
+		networkTypes = append(networkTypes,
+			webrtc.NetworkTypeTCP4,
+			webrtc.NetworkTypeTCP6,
+		)
+
+		for _, ip := range getICELocalAddresses() {
+			logICECandidate("tcp", ip, config.TCP_PORT)
+		}
+
+		icePorts = append(icePorts, config.TCP_PORT)
+	}
+
+	settingEngine.SetNetworkTypes(networkTypes)
+
+	if len(config.PUBLIC_IP) > 0 {
+		settingEngine.SetNAT1To1IPs(
+			config.PUBLIC_IP, webrtc.ICECandidateTypeHost,
+		)
+		slog.Info("nat 1 to 1 set to " + strings.Join(config.PUBLIC_IP, ", "))
+	}
+}
@@ -0,0 +1,33 @@
+package inuwebrtc
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// mouse, keyboard and clipboard events over data channels, so motion
+// isnt held up behind lost packets like it is over the websocket.
+// same format as websocket messages
+
+// handles input sent by the peer with this session
+var inputHandler atomic.Pointer[func(session string, message []byte)]
+
+func SetInputHandler(handle func(session string, message []byte)) {
+	inputHandler.Store(&handle)
+}
+
+func forwardInput(session string, channel *webrtc.DataChannel) {
+	channel.OnMessage(func(message webrtc.DataChannelMessage) {
+		if message.IsString || session == "" {
+			return
+		}
+
+		handle := inputHandler.Load()
+		if handle == nil {
+			return
+		}
+
+		(*handle)(session, message.Data)
+	})
+}
@@ -3,29 +3,27 @@ package inuwebrtc
 import (
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
-	"net"
 	"net/http"
-	"slices"
-	"strconv"
 	"sync"
 	"sync/atomic"
 
 	"github.com/makinori/inu-desktop/src/config"
 	"github.com/maniartech/signals"
-	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 )
 
 var (
-	LocalRtpVideoPort int
-	LocalRtpAudioPort int
-
 	api *webrtc.API
 
-	videoTrack *webrtc.TrackLocalStaticRTP
-	audioTrack *webrtc.TrackLocalStaticRTP
+	// replaced when the codec changes
+	videoTrack atomic.Pointer[rtpTrack]
+	audioTrack *rtpTrack
+
+	// for viewers that cant decode the video track's codec
+	fallbackVideoTrack *rtpTrack
 
 	peerConfig = webrtc.Configuration{
 		// shouldnt need to stun when using nat1to1
@@ -36,29 +34,35 @@ var (
 		// },
 	}
 
-	connectedPeers      []*webrtc.PeerConnection
-	connectedPeersMutex sync.RWMutex
+	connectedPeers peerList
+	fallbackPeers  peerList
 
+	// includes fallback viewers
 	ViewerCount       atomic.Uint32
 	ViewerCountSignal = signals.New[uint32]()
+
+	FallbackViewerCount       atomic.Uint32
+	FallbackViewerCountSignal = signals.New[uint32]()
+
+	// new viewers and lost pictures need a keyframe to decode from
+	KeyframeRequestSignal = signals.New[KeyframeRequest]()
 )
 
+type KeyframeRequest struct {
+	// 0 for the desktop
+	XID      uint32
+	Fallback bool
+}
+
 func initWebRTC() {
+	connectedPeers.onChange = updateViewerCount
+	fallbackPeers.onChange = updateViewerCount
+
 	// setup api
 
 	mediaEngine := &webrtc.MediaEngine{}
 
-	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeH264,
-			ClockRate:    90000,
-			Channels:     0,
-			SDPFmtpLine:  "",
-			RTCPFeedback: nil,
-		},
-		PayloadType: 96,
-	}, webrtc.RTPCodecTypeVideo)
-
+	err := registerVideoCodecs(mediaEngine)
 	if err != nil {
 		panic(err)
 	}
@@ -78,9 +82,22 @@ func initWebRTC() {
 		panic(err)
 	}
 
-	// // user configurable RTP/RTCP Pipeline
-	// // provides NACKs, RTCP Reports and other features
-	// interceptorRegistry := &interceptor.Registry{}
+	// user configurable RTP/RTCP Pipeline
+	// provides NACKs, RTCP Reports and other features
+	interceptorRegistry := &interceptor.Registry{}
+
+	// pipelines dont have an rtpbin so there's no sender reports.
+	// synthesized from when packets are written, which is the same clock
+	// for audio and video, so browsers can lip sync
+	err = webrtc.ConfigureRTCPReports(interceptorRegistry)
+	if err != nil {
+		panic(err)
+	}
+
+	err = configureStats(interceptorRegistry)
+	if err != nil {
+		panic(err)
+	}
 
 	// // this sends a PLI every 3 seconds
 	// // a PLI causes a video keyframe to be generated by the sender
@@ -95,61 +112,41 @@ func initWebRTC() {
 
 	// setup api
 
-	udpMux, err := ice.NewMultiUDPMuxFromPort(config.UDP_PORT)
-	if err != nil {
-		panic(err)
-	}
-	slog.Info("public udp listening at " + strconv.Itoa(config.UDP_PORT))
-
 	settingEngine := webrtc.SettingEngine{}
-	settingEngine.SetLite(true)
-	settingEngine.SetICEUDPMux(udpMux)
-	settingEngine.SetIncludeLoopbackCandidate(false)
-	settingEngine.SetInterfaceFilter(func(s string) (keep bool) {
-		return false
-	})
-	settingEngine.SetNetworkTypes([]webrtc.NetworkType{
-		webrtc.NetworkTypeUDP4,
-		webrtc.NetworkTypeUDP6,
-	})
-	settingEngine.SetNAT1To1IPs(
-		[]string{
-			config.PUBLIC_IP, // TODO: use dns??
-		},
-		webrtc.ICECandidateTypeHost,
-	)
+	setupICE(&settingEngine)
 
-	slog.Info("nat 1 to 1 set to " + config.PUBLIC_IP)
+	if config.TURN {
+		initTURN()
+	}
 
 	api = webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithSettingEngine(settingEngine),
-		// webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
 	)
 
 	// setup tracks
 
-	videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
-		MimeType: webrtc.MimeTypeH264,
-	}, "video", "inu")
+	SetVideoCodec(CodecH264)
 
-	if err != nil {
-		panic(err)
-	}
-
-	audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
-		MimeType: webrtc.MimeTypeOpus,
-	}, "audio", "inu")
+	fallbackVideoTrack = newRTPTrack(
+		CodecH264, "video", "inu", KeyframeRequest{Fallback: true},
+	)
 
-	if err != nil {
-		panic(err)
-	}
+	audioTrack = newRTPTrack(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: 48000,
+		Channels:  2,
+	}, "audio", "inu", KeyframeRequest{})
 }
 
+// closes the peer and writes an error response if the offer cant be answered
 func writeAnswer(
-	w http.ResponseWriter, r *http.Request, peer *webrtc.PeerConnection,
-	offer []byte, path string,
+	w http.ResponseWriter, r *http.Request, session *whepSession,
+	offer []byte,
 ) {
+	peer := session.peer
+
 	peer.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		slog.Info(getRequestIP(r) + " ice " + state.String())
 
@@ -158,183 +155,266 @@ func writeAnswer(
 		}
 	})
 
-	// fmt.Println(string(offer))
+	fail := func(status int, message string, err error) {
+		slog.Warn(message, "ip", getRequestIP(r), "err", err.Error())
+		peer.Close()
+		http.Error(w, message, status)
+	}
 
 	err := peer.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
 		SDP:  string(offer),
 	})
-
 	if err != nil {
-		peer.Close()
-		panic(err)
+		fail(http.StatusBadRequest, "invalid offer", err)
+		return
 	}
 
-	// can trickle ice packets with a PATCH request
-	// however i dont think it makes any sense when using nat1to1
-
-	gatherComplete := webrtc.GatheringCompletePromise(peer)
+	gatherComplete := gatheringCompletePromise(peer)
 
 	answer, err := peer.CreateAnswer(nil)
 	if err != nil {
-		peer.Close()
-		panic(err)
+		fail(http.StatusNotAcceptable, "failed to create answer", err)
+		return
 	}
 
+	// tracks are bound here, so fails without a matching codec
 	err = peer.SetLocalDescription(answer)
 	if err != nil {
-		peer.Close()
-		panic(err)
+		fail(http.StatusNotAcceptable, "failed to create answer", err)
+		return
 	}
 
-	<-gatherComplete
+	err = waitForGathering(r.Context(), gatherComplete)
+	if err != nil {
+		fail(http.StatusServiceUnavailable, "failed to gather candidates", err)
+		return
+	}
 
-	w.Header().Add("Location", path)
-	w.WriteHeader(http.StatusCreated)
+	session.mutex.Lock()
+	etag := session.etagHeader()
+	session.mutex.Unlock()
 
-	// fmt.Println(peer.LocalDescription().SDP)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", session.location())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Patch", sdpFragContentType)
+	setICEServerLinks(w)
+	w.WriteHeader(http.StatusCreated)
 
 	fmt.Fprint(w, peer.LocalDescription().SDP)
 }
 
-func updateViewerCount() {
-	connectedPeersMutex.RLock()
-	value := uint32(len(connectedPeers))
-	connectedPeersMutex.RUnlock()
-
-	if ViewerCount.Load() == value {
+// viewers already connected are closed so they renegotiate
+func SetVideoCodec(codec webrtc.RTPCodecCapability) {
+	current := videoTrack.Load()
+	if current != nil && sameCodec(current.Codec(), codec) {
 		return
 	}
 
-	ViewerCount.Store(value)
-	ViewerCountSignal.Emit(context.Background(), value)
-}
+	videoTrack.Store(newRTPTrack(codec, "video", "inu", KeyframeRequest{}))
 
-func whepHandler(w http.ResponseWriter, r *http.Request) {
-	offer, err := io.ReadAll(r.Body)
-	if err != nil {
-		panic(err)
+	if current != nil {
+		slog.Info("video codec changed", "mime", codec.MimeType,
+			"fmtp", codec.SDPFmtpLine)
+		connectedPeers.closeAll()
 	}
+}
 
-	peer, err := api.NewPeerConnection(peerConfig)
-	if err != nil {
-		panic(err)
-	}
+func updateViewerCount() {
+	fallback := uint32(fallbackPeers.count())
+	value := uint32(connectedPeers.count()) + fallback
 
-	peer.OnConnectionStateChange(func(connState webrtc.PeerConnectionState) {
-		switch connState {
-		case webrtc.PeerConnectionStateConnected:
-			connectedPeersMutex.Lock()
-			if slices.Contains(connectedPeers, peer) {
-				return
-			}
-			connectedPeers = append(connectedPeers, peer)
-			connectedPeersMutex.Unlock()
+	// store both first so listeners see the right split
+	fallbackChanged := FallbackViewerCount.Swap(fallback) != fallback
+	valueChanged := ViewerCount.Swap(value) != value
 
-			updateViewerCount()
+	if fallbackChanged {
+		FallbackViewerCountSignal.Emit(context.Background(), fallback)
+	}
 
-		case webrtc.PeerConnectionStateDisconnected,
-			webrtc.PeerConnectionStateFailed,
-			webrtc.PeerConnectionStateClosed:
+	if valueChanged {
+		ViewerCountSignal.Emit(context.Background(), value)
+	}
+}
 
-			connectedPeersMutex.Lock()
-			i := slices.Index(connectedPeers, peer)
-			if i < 0 {
-				break
-			}
-			connectedPeers = slices.Delete(connectedPeers, i, i+1)
-			connectedPeersMutex.Unlock()
+// starts sending to a newly connected peer.
+// returns false if there wasnt a keyframe to replay
+func goLive(peer *webrtc.PeerConnection) bool {
+	replayed := true
 
-			updateViewerCount()
+	for _, sender := range peer.GetSenders() {
+		track, ok := sender.Track().(*rtpTrack)
+		if !ok {
+			continue
 		}
-	})
 
-	rtpVideoSender, err := peer.AddTrack(videoTrack)
-	if err != nil {
-		peer.Close()
-		panic(err)
+		for _, encoding := range sender.GetParameters().Encodings {
+			if !track.goLive(encoding.SSRC) &&
+				track.Kind() == webrtc.RTPCodecTypeVideo {
+				replayed = false
+			}
+		}
 	}
 
-	rtpAudioSender, err := peer.AddTrack(audioTrack)
-	if err != nil {
-		peer.Close()
-		panic(err)
-	}
+	return replayed
+}
 
-	// read incoming RTCP packets
-	// before these packets are returned, they are processed by interceptors.
-	// for things like NACK this needs to be called.
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if peer.ConnectionState() == webrtc.PeerConnectionStateClosed {
-				break
-			}
-			rtpVideoSender.Read(rtcpBuf)
-			rtpAudioSender.Read(rtcpBuf)
+// read incoming RTCP packets
+// before these packets are returned, they are processed by interceptors.
+// for things like NACK this needs to be called.
+func readRTCP(
+	rtpSender *webrtc.RTPSender, track *rtpTrack, requestKeyframe func(),
+) {
+	for {
+		packets, _, err := rtpSender.ReadRTCP()
+		if err != nil {
+			return
 		}
-	}()
 
-	writeAnswer(w, r, peer, offer, "/whep")
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				requestKeyframe()
+			}
+		}
+	}
 }
 
-func udpServerForRTPToTrack(
-	port int, track *webrtc.TrackLocalStaticRTP,
+// creates a peer sending the tracks and answers the offer.
+// on closed is called once the peer has closed, if set
+func servePeer(
+	w http.ResponseWriter, r *http.Request, offer []byte, peers *peerList,
+	tracks []*rtpTrack, keyframe KeyframeRequest, onClosed func(),
 ) {
-	l, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP: net.ParseIP("127.0.0.1"), Port: port,
-	})
-	if err != nil {
-		panic(err)
+	requestKeyframe := func() {
+		KeyframeRequestSignal.Emit(context.Background(), keyframe)
+	}
+
+	if onClosed == nil {
+		onClosed = func() {}
 	}
+	// failed and closed both happen
+	onClosed = sync.OnceFunc(onClosed)
 
-	bufferSize := 300000 // 300KB
-	err = l.SetReadBuffer(bufferSize)
+	session := joinSession(r.URL.Query().Get("session"), keyframe.XID)
+
+	peer, statsGetter, err := newPeerConnection()
 	if err != nil {
-		panic(err)
+		slog.Error("failed to create peer", "err", err.Error())
+		onClosed()
+		http.Error(w, "failed to create peer", http.StatusServiceUnavailable)
+		return
 	}
 
-	defer func() {
-		err = l.Close()
-		if err != nil {
-			panic(err)
+	whep := newWHEPSession(peer)
+
+	addStatsPeer(
+		whep.id, session, getStreamName(keyframe), peer, statsGetter,
+	)
+
+	// browser microphone when offered as sendrecv
+	peer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			forwardMic(session, track)
 		}
-	}()
+	})
 
-	packet := make([]byte, 1600)
-	for {
-		n, _, err := l.ReadFrom(packet)
+	// input when the browser negotiated data channels
+	peer.OnDataChannel(func(channel *webrtc.DataChannel) {
+		forwardInput(session, channel)
+	})
+
+	peer.OnConnectionStateChange(func(connState webrtc.PeerConnectionState) {
+		switch connState {
+		case webrtc.PeerConnectionStateConnected:
+			peers.add(peer)
+			if !goLive(peer) {
+				requestKeyframe()
+			}
+
+		// might come back after an ice restart
+		case webrtc.PeerConnectionStateDisconnected:
+			peers.remove(peer)
+
+		case webrtc.PeerConnectionStateFailed,
+			webrtc.PeerConnectionStateClosed:
+			peers.remove(peer)
+			whep.remove()
+			removeStatsPeer(peer)
+			onClosed()
+		}
+	})
+
+	for _, track := range tracks {
+		rtpSender, err := peer.AddTrack(track)
 		if err != nil {
-			slog.Error("rtp track read error", "err", err)
-			continue
+			slog.Error("failed to add track", "err", err.Error())
+			peer.Close()
+			http.Error(w, "failed to add track", http.StatusInternalServerError)
+			return
 		}
 
-		track.Write(packet[:n])
+		go readRTCP(rtpSender, track, requestKeyframe)
 	}
-}
 
-func Init(httpMux *http.ServeMux) {
-	initWebRTC()
-
-	httpMux.HandleFunc("POST /whep", whepHandler)
+	writeAnswer(w, r, whep, offer)
+}
 
-	var err error
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
 
-	LocalRtpVideoPort, err = getFreeUDPPort()
-	if err != nil {
-		panic(err)
+	track, peers := videoTrack.Load(), &connectedPeers
+	if !offerSupports(offer, track.Codec()) {
+		track, peers = fallbackVideoTrack, &fallbackPeers
 	}
 
-	LocalRtpAudioPort, err = getFreeUDPPort()
-	if err != nil {
-		panic(err)
+	if !offerSupports(offer, track.Codec()) {
+		http.Error(w, "offer has no supported video codec",
+			http.StatusNotAcceptable)
+		return
 	}
 
-	slog.Info(
-		"local rtp listening", "video", LocalRtpVideoPort,
-		"audio", strconv.Itoa(LocalRtpAudioPort),
+	servePeer(
+		w, r, offer, peers,
+		[]*rtpTrack{track, audioTrack},
+		track.keyframe, nil,
 	)
+}
+
+// rtp packets from gstreamer
+func WriteVideoRTP(packet []byte) {
+	videoTrack.Load().writeRTP(packet)
+}
+
+func WriteFallbackVideoRTP(packet []byte) {
+	fallbackVideoTrack.writeRTP(packet)
+}
+
+func WriteAudioRTP(packet []byte) {
+	audioTrack.writeRTP(packet)
+}
+
+func Init(httpMux *http.ServeMux) {
+	initWebRTC()
 
-	go udpServerForRTPToTrack(LocalRtpVideoPort, videoTrack)
-	go udpServerForRTPToTrack(LocalRtpAudioPort, audioTrack)
+	httpMux.HandleFunc("POST /whep",
+		countWHEPRequests("whep", whepHandler))
+	httpMux.HandleFunc("POST /whep/window/{id}",
+		countWHEPRequests("whep-window", whepWindowHandler))
+	httpMux.HandleFunc("OPTIONS /whep", whepOptionsHandler)
+	httpMux.HandleFunc("OPTIONS /whep/window/{id}", whepOptionsHandler)
+
+	httpMux.HandleFunc("PATCH /whep/session/{id}",
+		countWHEPRequests("whep-session", whepSessionPatchHandler))
+	httpMux.HandleFunc("DELETE /whep/session/{id}",
+		countWHEPRequests("whep-session", whepSessionDeleteHandler))
+	httpMux.HandleFunc("OPTIONS /whep/session/{id}", whepSessionOptionsHandler)
 }
@@ -0,0 +1,124 @@
+package inuwebrtc
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestMain(m *testing.M) {
+	// any free port, and no ice-tcp so the web port isnt taken
+	config.UDP_PORT = 0
+	config.TCP_PORT = 0
+
+	initWebRTC()
+
+	os.Exit(m.Run())
+}
+
+// a player with pion's default codecs, unless given its own
+func newTestClient(
+	t *testing.T, mediaEngine *webrtc.MediaEngine,
+) *webrtc.PeerConnection {
+	t.Helper()
+
+	if mediaEngine == nil {
+		mediaEngine = &webrtc.MediaEngine{}
+		err := mediaEngine.RegisterDefaultCodecs()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+	).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// recvonly video and audio, with candidates
+func newTestOffer(t *testing.T, client *webrtc.PeerConnection) string {
+	t.Helper()
+
+	for _, kind := range []webrtc.RTPCodecType{
+		webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio,
+	} {
+		_, err := client.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(client)
+
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.SetLocalDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-gatherComplete
+
+	return client.LocalDescription().SDP
+}
+
+func removeSDPLines(description string, prefix string) string {
+	var removed strings.Builder
+	for line := range strings.Lines(description) {
+		if !strings.HasPrefix(line, prefix) {
+			removed.WriteString(line)
+		}
+	}
+	return removed.String()
+}
+
+func countStatsPeers() int {
+	statsPeersMutex.Lock()
+	defer statsPeersMutex.Unlock()
+	return len(statsPeers)
+}
+
+func countWHEPSessions() int {
+	whepSessionsMutex.Lock()
+	defer whepSessionsMutex.Unlock()
+	return len(whepSessions)
+}
+
+// pion reports closed from another goroutine
+func waitFor(t *testing.T, what string, check func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// every peer made by a test should be gone once it's done
+func waitForPeersClosed(t *testing.T) {
+	t.Helper()
+
+	waitFor(t, "peers to close", func() bool {
+		return countWHEPSessions() == 0 && countStatsPeers() == 0 &&
+			connectedPeers.count() == 0 && fallbackPeers.count() == 0
+	})
+}
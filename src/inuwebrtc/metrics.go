@@ -0,0 +1,54 @@
+package inuwebrtc
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	rtpPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inu_rtp_packets_total",
+		Help: "RTP packets forwarded to peers.",
+	}, []string{"stream", "kind"})
+
+	rtpBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inu_rtp_bytes_total",
+		Help: "RTP payload bytes forwarded to peers.",
+	}, []string{"stream", "kind"})
+
+	rtpDroppedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inu_rtp_dropped_packets_total",
+		Help: "RTP packets that couldn't be parsed or written to a peer.",
+	}, []string{"stream", "kind"})
+
+	whepRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inu_whep_requests_total",
+		Help: "WHEP requests by response code.",
+	}, []string{"handler", "method", "code"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "inu_viewers",
+		Help: "Connected viewers, including fallback viewers.",
+	}, func() float64 {
+		return float64(ViewerCount.Load())
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "inu_fallback_viewers",
+		Help: "Connected viewers on the fallback video codec.",
+	}, func() float64 {
+		return float64(FallbackViewerCount.Load())
+	})
+)
+
+func countWHEPRequests(
+	handler string, next http.HandlerFunc,
+) http.HandlerFunc {
+	return promhttp.InstrumentHandlerCounter(
+		whepRequests.MustCurryWith(prometheus.Labels{"handler": handler}),
+		next,
+	)
+}
@@ -0,0 +1,58 @@
+package inuwebrtc
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const MicPayloadType = 111
+
+var (
+	// sends rtp to the mic pipeline
+	micWriter atomic.Pointer[func([]byte)]
+
+	// only the peer with this session may send to the virtual mic
+	micSession atomic.Pointer[string]
+)
+
+func SetMicSession(session string) {
+	micSession.Store(&session)
+}
+
+func SetMicWriter(write func([]byte)) {
+	micWriter.Store(&write)
+}
+
+func canSendMic(session string) bool {
+	current := micSession.Load()
+	return session != "" && current != nil && *current == session
+}
+
+func forwardMic(session string, track *webrtc.TrackRemote) {
+	if track.Codec().MimeType != webrtc.MimeTypeOpus {
+		return
+	}
+
+	packet := make([]byte, 1600)
+	for {
+		n, _, err := track.Read(packet)
+		if err != nil {
+			return
+		}
+
+		if n < 12 || !canSendMic(session) {
+			continue
+		}
+
+		write := micWriter.Load()
+		if write == nil {
+			continue
+		}
+
+		// firefox uses a different payload type for opus
+		packet[1] = packet[1]&0x80 | MicPayloadType
+
+		(*write)(packet[:n])
+	}
+}
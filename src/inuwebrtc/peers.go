@@ -0,0 +1,57 @@
+package inuwebrtc
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// connected peers of a stream
+type peerList struct {
+	peers    []*webrtc.PeerConnection
+	mutex    sync.RWMutex
+	onChange func()
+}
+
+func (l *peerList) add(peer *webrtc.PeerConnection) {
+	l.mutex.Lock()
+	if slices.Contains(l.peers, peer) {
+		l.mutex.Unlock()
+		return
+	}
+	l.peers = append(l.peers, peer)
+	l.mutex.Unlock()
+
+	l.onChange()
+}
+
+// calls on change even if the peer never connected,
+// so streams without any peers can be cleaned up
+func (l *peerList) remove(peer *webrtc.PeerConnection) {
+	l.mutex.Lock()
+	i := slices.Index(l.peers, peer)
+	if i >= 0 {
+		l.peers = slices.Delete(l.peers, i, i+1)
+	}
+	l.mutex.Unlock()
+
+	l.onChange()
+}
+
+func (l *peerList) count() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.peers)
+}
+
+// peers are removed once their connection state changes
+func (l *peerList) closeAll() {
+	l.mutex.RLock()
+	peers := slices.Clone(l.peers)
+	l.mutex.RUnlock()
+
+	for _, peer := range peers {
+		peer.Close()
+	}
+}
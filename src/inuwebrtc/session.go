@@ -0,0 +1,22 @@
+package inuwebrtc
+
+import "sync/atomic"
+
+// sessions are issued by the websocket, so peers can only claim the one
+// their page was given. mic, input and stats need a known session, and
+// input from a session watching a window is limited to that window
+
+var sessionHandler atomic.Pointer[func(session string, xid uint32) bool]
+
+func SetSessionHandler(handle func(session string, xid uint32) bool) {
+	sessionHandler.Store(&handle)
+}
+
+// empty if the session wasnt issued
+func joinSession(session string, xid uint32) string {
+	handle := sessionHandler.Load()
+	if session == "" || handle == nil || !(*handle)(session, xid) {
+		return ""
+	}
+	return session
+}
@@ -0,0 +1,233 @@
+package inuwebrtc
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// per peer stats from what's sent and the receiver reports coming back,
+// so there's some idea why a viewer is laggy
+
+type TrackStats struct {
+	Kind  string `json:"kind"`
+	Codec string `json:"codec"`
+	// bits per second
+	Bitrate     float64 `json:"bitrate"`
+	BytesSent   uint64  `json:"bytesSent"`
+	PacketsSent uint64  `json:"packetsSent"`
+	// from receiver reports
+	PacketsLost  int64   `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+	// seconds
+	Jitter    float64 `json:"jitter"`
+	RTT       float64 `json:"rtt"`
+	NACKCount uint32  `json:"nackCount"`
+	PLICount  uint32  `json:"pliCount"`
+	FIRCount  uint32  `json:"firCount"`
+}
+
+type PeerStats struct {
+	// whep session
+	ID      string `json:"id"`
+	Session string `json:"session"`
+	// desktop, fallback, window or whip
+	Stream string `json:"stream"`
+	State  string `json:"state"`
+	// selected candidate pair
+	LocalCandidate  string       `json:"localCandidate"`
+	RemoteCandidate string       `json:"remoteCandidate"`
+	Tracks          []TrackStats `json:"tracks"`
+}
+
+type statsPeer struct {
+	id      string
+	session string
+	stream  string
+	peer    *webrtc.PeerConnection
+	getter  stats.Getter
+
+	// for the bitrate
+	lastTime    time.Time
+	lastBytes   map[uint32]uint64
+	lastBitrate map[uint32]float64
+}
+
+const minBitrateInterval = time.Second
+
+var (
+	statsPeers      []*statsPeer
+	statsPeersMutex sync.Mutex
+
+	// the interceptor hands out a getter while a peer is being made
+	newStatsGetter         stats.Getter
+	newPeerConnectionMutex sync.Mutex
+)
+
+func configureStats(interceptorRegistry *interceptor.Registry) error {
+	statsInterceptor, err := stats.NewInterceptor()
+	if err != nil {
+		return err
+	}
+
+	statsInterceptor.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		newStatsGetter = getter
+	})
+
+	interceptorRegistry.Add(statsInterceptor)
+
+	return nil
+}
+
+func newPeerConnection() (*webrtc.PeerConnection, stats.Getter, error) {
+	newPeerConnectionMutex.Lock()
+	defer newPeerConnectionMutex.Unlock()
+
+	newStatsGetter = nil
+
+	peer, err := api.NewPeerConnection(getPeerConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return peer, newStatsGetter, nil
+}
+
+func getStreamName(keyframe KeyframeRequest) string {
+	if keyframe.XID != 0 {
+		return "window"
+	} else if keyframe.Fallback {
+		return "fallback"
+	}
+	return "desktop"
+}
+
+func addStatsPeer(
+	id, session, stream string, peer *webrtc.PeerConnection,
+	getter stats.Getter,
+) {
+	statsPeersMutex.Lock()
+	defer statsPeersMutex.Unlock()
+
+	statsPeers = append(statsPeers, &statsPeer{
+		id:          id,
+		session:     session,
+		stream:      stream,
+		peer:        peer,
+		getter:      getter,
+		lastBytes:   map[uint32]uint64{},
+		lastBitrate: map[uint32]float64{},
+	})
+}
+
+func removeStatsPeer(peer *webrtc.PeerConnection) {
+	statsPeersMutex.Lock()
+	defer statsPeersMutex.Unlock()
+
+	statsPeers = slices.DeleteFunc(statsPeers, func(p *statsPeer) bool {
+		return p.peer == peer
+	})
+}
+
+// must be called with mutex locked
+func (p *statsPeer) getStats(now time.Time) PeerStats {
+	peerStats := PeerStats{
+		ID:      p.id,
+		Session: p.session,
+		Stream:  p.stream,
+		State:   p.peer.ConnectionState().String(),
+		Tracks:  []TrackStats{},
+	}
+
+	updateBitrate := now.Sub(p.lastTime) >= minBitrateInterval
+	elapsed := now.Sub(p.lastTime).Seconds()
+
+	for _, sender := range p.peer.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+
+		if peerStats.LocalCandidate == "" && sender.Transport() != nil {
+			pair, err := sender.Transport().ICETransport().
+				GetSelectedCandidatePair()
+			if err == nil && pair != nil {
+				peerStats.LocalCandidate = pair.Local.String()
+				peerStats.RemoteCandidate = pair.Remote.String()
+			}
+		}
+
+		parameters := sender.GetParameters()
+
+		codec := ""
+		if len(parameters.Codecs) > 0 {
+			codec = parameters.Codecs[0].MimeType
+		}
+
+		for _, encoding := range parameters.Encodings {
+			ssrc := uint32(encoding.SSRC)
+
+			trackStats := TrackStats{
+				Kind:  track.Kind().String(),
+				Codec: codec,
+			}
+
+			var streamStats *stats.Stats
+			if p.getter != nil {
+				streamStats = p.getter.Get(ssrc)
+			}
+
+			if streamStats != nil {
+				outbound := streamStats.OutboundRTPStreamStats
+				remote := streamStats.RemoteInboundRTPStreamStats
+
+				trackStats.BytesSent = outbound.BytesSent
+				trackStats.PacketsSent = outbound.PacketsSent
+				trackStats.NACKCount = outbound.NACKCount
+				trackStats.PLICount = outbound.PLICount
+				trackStats.FIRCount = outbound.FIRCount
+				trackStats.PacketsLost = remote.PacketsLost
+				trackStats.FractionLost = remote.FractionLost
+				trackStats.Jitter = remote.Jitter
+				trackStats.RTT = remote.RoundTripTime.Seconds()
+			}
+
+			if updateBitrate {
+				lastBytes, ok := p.lastBytes[ssrc]
+				if ok && trackStats.BytesSent >= lastBytes {
+					p.lastBitrate[ssrc] =
+						float64(trackStats.BytesSent-lastBytes) * 8 / elapsed
+				}
+				p.lastBytes[ssrc] = trackStats.BytesSent
+			}
+
+			trackStats.Bitrate = p.lastBitrate[ssrc]
+
+			peerStats.Tracks = append(peerStats.Tracks, trackStats)
+		}
+	}
+
+	if updateBitrate {
+		p.lastTime = now
+	}
+
+	return peerStats
+}
+
+func GetPeerStats() []PeerStats {
+	statsPeersMutex.Lock()
+	defer statsPeersMutex.Unlock()
+
+	now := time.Now()
+
+	peerStats := []PeerStats{}
+	for _, peer := range statsPeers {
+		peerStats = append(peerStats, peer.getStats(now))
+	}
+
+	return peerStats
+}
@@ -0,0 +1,174 @@
+package inuwebrtc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// ice-tcp for networks that block udp. can share the web port, connections
+// are told apart by the stun magic cookie in the first message
+
+const demuxTimeout = time.Second * 10
+
+var (
+	// set when ice-tcp shares the web port, http should be served on this
+	WebListener net.Listener
+
+	// rfc 4571 framing is 2 bytes of length before the stun header
+	stunMagicCookie = []byte{0x21, 0x12, 0xa4, 0x42}
+)
+
+// accepts connections handed to it by the demuxer
+type chanListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *chanListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// replays what was peeked
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func demuxConn(conn net.Conn, iceListener, webListener *chanListener) {
+	conn.SetReadDeadline(time.Now().Add(demuxTimeout))
+
+	reader := bufio.NewReader(conn)
+	header, err := reader.Peek(10)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	peeked := &peekedConn{Conn: conn, reader: reader}
+
+	if bytes.Equal(header[6:10], stunMagicCookie) {
+		iceListener.push(peeked)
+	} else {
+		webListener.push(peeked)
+	}
+}
+
+// returns once the listener is closed
+func serveDemux(listener net.Listener, iceListener, webListener *chanListener) {
+	defer iceListener.Close()
+	defer webListener.Close()
+
+	// backs off like http.Server, for things like running out of files
+	var delay time.Duration
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(delay*2, time.Second)
+			}
+			slog.Error(
+				"failed to accept tcp", "err", err.Error(), "retry", delay,
+			)
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+		go demuxConn(conn, iceListener, webListener)
+	}
+}
+
+func listenICETCP() (net.Listener, error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.TCP_PORT))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TCP_PORT != config.WEB_PORT {
+		slog.Info("public ice tcp listening at " + strconv.Itoa(config.TCP_PORT))
+		return listener, nil
+	}
+
+	iceListener := newChanListener(listener.Addr())
+	webListener := newChanListener(listener.Addr())
+
+	go serveDemux(listener, iceListener, webListener)
+
+	WebListener = webListener
+
+	slog.Info(
+		"public ice tcp listening at " + strconv.Itoa(config.TCP_PORT) +
+			", shared with http",
+	)
+
+	return iceListener, nil
+}
+
+func setupICETCP(settingEngine *webrtc.SettingEngine) {
+	listener, err := listenICETCP()
+	if err != nil {
+		panic(err)
+	}
+
+	settingEngine.SetICETCPMux(ice.NewTCPMuxDefault(ice.TCPMuxParams{
+		Listener:        listener,
+		ReadBufferSize:  8,
+		WriteBufferSize: 4 * 1024 * 1024,
+	}))
+}
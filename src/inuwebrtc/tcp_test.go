@@ -0,0 +1,78 @@
+package inuwebrtc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fails a few times like running out of files, then hands out conns
+type flakyListener struct {
+	failures int
+	conns    chan net.Conn
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *flakyListener) Close() error   { return nil }
+func (l *flakyListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestDemuxRetriesAccept(t *testing.T) {
+	listener := &flakyListener{failures: 3, conns: make(chan net.Conn, 1)}
+	iceListener := newChanListener(listener.Addr())
+	webListener := newChanListener(listener.Addr())
+
+	done := make(chan struct{})
+	go func() {
+		serveDemux(listener, iceListener, webListener)
+		close(done)
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	listener.conns <- server
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := webListener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopped accepting after errors")
+	}
+
+	close(listener.conns)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didnt return once closed")
+	}
+
+	_, err := iceListener.Accept()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected closed, got %v", err)
+	}
+}
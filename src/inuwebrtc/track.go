@@ -0,0 +1,278 @@
+package inuwebrtc
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// should be plenty for a gop, otherwise wait for the next keyframe
+const maxCachedPackets = 5000
+
+type trackBinding struct {
+	id          string
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+	// only sent live packets once the cache has been replayed
+	live bool
+}
+
+// like webrtc.TrackLocalStaticRTP but:
+//
+// every pipeline start has a new ssrc, sequence and timestamp base.
+// peers would see a discontinuity and decoders often stall, so packets
+// are rewritten to look like one continuous stream.
+//
+// packets since the last keyframe are kept and replayed to new peers
+// so they dont have to wait for the next one
+type rtpTrack struct {
+	id       string
+	streamID string
+	codec    webrtc.RTPCodecCapability
+	keyframe KeyframeRequest
+
+	mutex    sync.Mutex
+	bindings []*trackBinding
+
+	cache      []*rtp.Packet
+	cacheValid bool
+
+	started bool
+	// of the current source
+	ssrc            uint32
+	seqOffset       uint16
+	timestampOffset uint32
+	// last written
+	seq       uint16
+	timestamp uint32
+	wallTime  time.Time
+
+	packets        prometheus.Counter
+	bytes          prometheus.Counter
+	droppedPackets prometheus.Counter
+}
+
+func newRTPTrack(
+	codec webrtc.RTPCodecCapability, id string, streamID string,
+	keyframe KeyframeRequest,
+) *rtpTrack {
+	track := &rtpTrack{
+		id:       id,
+		streamID: streamID,
+		codec:    codec,
+		keyframe: keyframe,
+	}
+
+	labels := []string{getStreamName(keyframe), track.Kind().String()}
+	track.packets = rtpPackets.WithLabelValues(labels...)
+	track.bytes = rtpBytes.WithLabelValues(labels...)
+	track.droppedPackets = rtpDroppedPackets.WithLabelValues(labels...)
+
+	return track
+}
+
+func (track *rtpTrack) ID() string       { return track.id }
+func (track *rtpTrack) RID() string      { return "" }
+func (track *rtpTrack) StreamID() string { return track.streamID }
+
+func (track *rtpTrack) Codec() webrtc.RTPCodecCapability { return track.codec }
+
+func (track *rtpTrack) Kind() webrtc.RTPCodecType {
+	if strings.HasPrefix(track.codec.MimeType, "audio/") {
+		return webrtc.RTPCodecTypeAudio
+	}
+	return webrtc.RTPCodecTypeVideo
+}
+
+func (track *rtpTrack) Bind(
+	trackContext webrtc.TrackLocalContext,
+) (webrtc.RTPCodecParameters, error) {
+	for _, codec := range trackContext.CodecParameters() {
+		// unlike pion, never fall back to a codec with another profile
+		if !strings.EqualFold(codec.MimeType, track.codec.MimeType) ||
+			!fmtpMatches(
+				codec.MimeType, codec.SDPFmtpLine, track.codec.SDPFmtpLine,
+			) {
+			continue
+		}
+
+		track.mutex.Lock()
+		track.bindings = append(track.bindings, &trackBinding{
+			id:          trackContext.ID(),
+			ssrc:        trackContext.SSRC(),
+			payloadType: codec.PayloadType,
+			writeStream: trackContext.WriteStream(),
+		})
+		track.mutex.Unlock()
+
+		return codec, nil
+	}
+
+	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+func (track *rtpTrack) Unbind(trackContext webrtc.TrackLocalContext) error {
+	track.mutex.Lock()
+	defer track.mutex.Unlock()
+
+	i := slices.IndexFunc(track.bindings, func(binding *trackBinding) bool {
+		return binding.id == trackContext.ID()
+	})
+	if i < 0 {
+		return webrtc.ErrUnbindFailed
+	}
+
+	track.bindings = slices.Delete(track.bindings, i, i+1)
+
+	return nil
+}
+
+func (binding *trackBinding) write(packet *rtp.Packet) error {
+	// cached packets are shared between bindings
+	header := packet.Header
+	header.SSRC = uint32(binding.ssrc)
+	header.PayloadType = uint8(binding.payloadType)
+	_, err := binding.writeStream.WriteRTP(&header, packet.Payload)
+	return err
+}
+
+// must be called with mutex locked
+func (track *rtpTrack) writeBinding(
+	binding *trackBinding, packet *rtp.Packet,
+) {
+	err := binding.write(packet)
+	if err != nil {
+		track.droppedPackets.Inc()
+		return
+	}
+
+	track.packets.Inc()
+	track.bytes.Add(float64(len(packet.Payload)))
+}
+
+// call once the peer has connected, anything written before is dropped.
+// returns false if there wasnt anything cached to replay
+func (track *rtpTrack) goLive(ssrc webrtc.SSRC) bool {
+	track.mutex.Lock()
+	defer track.mutex.Unlock()
+
+	replayed := false
+
+	for _, binding := range track.bindings {
+		if binding.ssrc != ssrc || binding.live {
+			continue
+		}
+
+		if track.cacheValid && len(track.cache) > 0 {
+			for _, packet := range track.cache {
+				track.writeBinding(binding, packet)
+			}
+			replayed = true
+		}
+
+		binding.live = true
+	}
+
+	return replayed
+}
+
+// must be called with mutex locked. returns true if the source changed
+func (track *rtpTrack) rewrite(packet *rtp.Packet) bool {
+	switched := false
+
+	if !track.started || packet.SSRC != track.ssrc {
+		nextSeq := track.seq + 1
+		nextTimestamp := track.timestamp + 1
+
+		// carry on from where the last source left off as if
+		// it never stopped, so jitter buffers dont get confused
+		if track.started {
+			elapsed := time.Since(track.wallTime)
+			nextTimestamp = track.timestamp + max(1, uint32(
+				elapsed.Seconds()*float64(track.codec.ClockRate),
+			))
+		}
+
+		track.seqOffset = nextSeq - packet.SequenceNumber
+		track.timestampOffset = nextTimestamp - packet.Timestamp
+		track.ssrc = packet.SSRC
+
+		switched = track.started
+		track.started = true
+
+		// old packets wont decode with the new source
+		track.cache = nil
+		track.cacheValid = false
+	}
+
+	packet.SequenceNumber += track.seqOffset
+	packet.Timestamp += track.timestampOffset
+
+	track.seq = packet.SequenceNumber
+	track.timestamp = packet.Timestamp
+	track.wallTime = time.Now()
+
+	return switched
+}
+
+// must be called with mutex locked
+func (track *rtpTrack) updateCache(packet *rtp.Packet) {
+	if track.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	// sps and pps come before the idr with the same timestamp
+	if isKeyframeStart(track.codec.MimeType, packet.Payload) &&
+		(!track.cacheValid || len(track.cache) == 0 ||
+			track.cache[0].Timestamp != packet.Timestamp) {
+		track.cache = track.cache[:0]
+		track.cacheValid = true
+	}
+
+	if !track.cacheValid {
+		return
+	}
+
+	if len(track.cache) >= maxCachedPackets {
+		track.cache = nil
+		track.cacheValid = false
+		return
+	}
+
+	track.cache = append(track.cache, packet)
+}
+
+func (track *rtpTrack) writeRTP(data []byte) {
+	var packet rtp.Packet
+	// might be cached and the buffer reused
+	err := packet.Unmarshal(slices.Clone(data))
+	if err != nil {
+		track.droppedPackets.Inc()
+		return
+	}
+
+	track.mutex.Lock()
+
+	switched := track.rewrite(&packet)
+	track.updateCache(&packet)
+
+	for _, binding := range track.bindings {
+		if binding.live {
+			track.writeBinding(binding, &packet)
+		}
+	}
+
+	track.mutex.Unlock()
+
+	if switched && track.Kind() == webrtc.RTPCodecTypeVideo {
+		// dont block the pipeline
+		go KeyframeRequestSignal.Emit(context.Background(), track.keyframe)
+	}
+}
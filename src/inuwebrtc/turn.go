@@ -0,0 +1,251 @@
+package inuwebrtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// turn server for viewers behind symmetric nats. it only relays to the
+// desktop, which is on the same machine, so it's not an open relay
+
+var (
+	turnURLs []string
+
+	// for time limited credentials, generated if not set
+	turnSecret string
+
+	// advertised ip to what it is on this machine,
+	// as the network might not be able to hairpin
+	turnRoutes []natMapping
+)
+
+// relays to the public ips are sent locally instead.
+// permissions only have the peer's ip, so ports are limited to ice's here
+type turnRelayConn struct {
+	net.PacketConn
+}
+
+func isICEPort(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return ok && slices.Contains(icePorts, udpAddr.Port)
+}
+
+func (c *turnRelayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	// dropped like a firewall would
+	if !isICEPort(addr) {
+		return len(p), nil
+	}
+
+	udpAddr := addr.(*net.UDPAddr)
+	for _, route := range turnRoutes {
+		if udpAddr.IP.Equal(route.external) {
+			addr = &net.UDPAddr{IP: route.local, Port: udpAddr.Port}
+			break
+		}
+	}
+
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *turnRelayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if !isICEPort(addr) {
+			continue
+		}
+
+		udpAddr := addr.(*net.UDPAddr)
+		for _, route := range turnRoutes {
+			if udpAddr.IP.Equal(route.local) {
+				addr = &net.UDPAddr{IP: route.external, Port: udpAddr.Port}
+				break
+			}
+		}
+
+		return n, addr, err
+	}
+}
+
+type turnRelayAddressGenerator struct {
+	*turn.RelayAddressGeneratorPortRange
+}
+
+func (g turnRelayAddressGenerator) AllocatePacketConn(
+	network string, requestedPort int,
+) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGeneratorPortRange.AllocatePacketConn(
+		network, requestedPort,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &turnRelayConn{conn}, addr, nil
+}
+
+func getTURNLocalIP(external net.IP) net.IP {
+	// doesnt send anything, just finds the route
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{
+		IP: external, Port: config.UDP_PORT,
+	})
+	if err != nil {
+		return external
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func getTURNAuthHandler() turn.AuthHandler {
+	if config.TURN_USERNAME != "" {
+		key := turn.GenerateAuthKey(
+			config.TURN_USERNAME, config.TURN_REALM, config.TURN_PASSWORD,
+		)
+		return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return key, username == config.TURN_USERNAME
+		}
+	}
+
+	return turn.LongTermTURNRESTAuthHandler(turnSecret, nil)
+}
+
+// credentials are made per request when they're time limited
+func getICEServers() []webrtc.ICEServer {
+	servers := slices.Clone(peerConfig.ICEServers)
+
+	if len(turnURLs) == 0 {
+		return servers
+	}
+
+	username, credential := config.TURN_USERNAME, config.TURN_PASSWORD
+	if username == "" {
+		var err error
+		username, credential, err = turn.GenerateLongTermTURNRESTCredentials(
+			turnSecret, "inu", config.TURN_CREDENTIAL_TTL,
+		)
+		if err != nil {
+			slog.Error("failed to generate turn credentials", "err", err.Error())
+			return servers
+		}
+	}
+
+	return append(servers, webrtc.ICEServer{
+		URLs:       turnURLs,
+		Username:   username,
+		Credential: credential,
+	})
+}
+
+func getPeerConfig() webrtc.Configuration {
+	configuration := peerConfig
+	configuration.ICEServers = getICEServers()
+	return configuration
+}
+
+// only relays to the routes, on ice's ports
+func newTURNServer(
+	udpListener net.PacketConn, tcpListener net.Listener,
+) (*turn.Server, error) {
+	// relays are listened for on ipv4
+	relayAddress := turnRoutes[0].external
+	for _, route := range turnRoutes {
+		if isIPv4(route.external) {
+			relayAddress = route.external
+			break
+		}
+	}
+
+	relayAddressGenerator := turnRelayAddressGenerator{
+		&turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayAddress,
+			Address:      "0.0.0.0",
+			MinPort:      uint16(config.TURN_RELAY_MIN_PORT),
+			MaxPort:      uint16(config.TURN_RELAY_MAX_PORT),
+		},
+	}
+
+	permissionHandler := func(clientAddr net.Addr, peerIP net.IP) bool {
+		return slices.ContainsFunc(turnRoutes, func(route natMapping) bool {
+			return peerIP.Equal(route.external)
+		})
+	}
+
+	return turn.NewServer(turn.ServerConfig{
+		Realm:       config.TURN_REALM,
+		AuthHandler: getTURNAuthHandler(),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: relayAddressGenerator,
+				PermissionHandler:     permissionHandler,
+			},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              tcpListener,
+				RelayAddressGenerator: relayAddressGenerator,
+				PermissionHandler:     permissionHandler,
+			},
+		},
+	})
+}
+
+func initTURN() {
+	if len(natMappings) == 0 {
+		panic("TURN needs PUBLIC_IP")
+	}
+
+	for _, mapping := range natMappings {
+		if mapping.local == nil {
+			mapping.local = getTURNLocalIP(mapping.external)
+		}
+		turnRoutes = append(turnRoutes, mapping)
+	}
+
+	turnSecret = config.TURN_SECRET
+	if turnSecret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		turnSecret = hex.EncodeToString(secret)
+	}
+
+	address := ":" + strconv.Itoa(config.TURN_PORT)
+
+	udpListener, err := net.ListenPacket("udp", address)
+	if err != nil {
+		panic(err)
+	}
+
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = newTURNServer(udpListener, tcpListener)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, route := range turnRoutes {
+		host := net.JoinHostPort(
+			route.external.String(), strconv.Itoa(config.TURN_PORT),
+		)
+		turnURLs = append(turnURLs,
+			"turn:"+host+"?transport=udp",
+			"turn:"+host+"?transport=tcp",
+		)
+	}
+
+	slog.Info("public turn listening at " + strconv.Itoa(config.TURN_PORT))
+}
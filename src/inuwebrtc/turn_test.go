@@ -0,0 +1,196 @@
+package inuwebrtc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/pion/turn/v4"
+)
+
+var localhost = net.ParseIP("127.0.0.1")
+
+func listenLocalUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// relays to localhost, with ice pretending to be on the given port
+func startTestTURN(t *testing.T, icePort int) string {
+	t.Helper()
+
+	defaultRoutes, defaultPorts := turnRoutes, icePorts
+	t.Cleanup(func() {
+		turnRoutes, icePorts = defaultRoutes, defaultPorts
+	})
+	turnRoutes = []natMapping{{external: localhost, local: localhost}}
+	icePorts = []int{icePort}
+
+	udpListener := listenLocalUDP(t)
+
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := newTURNServer(udpListener, tcpListener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return udpListener.LocalAddr().String()
+}
+
+func newTestTURNClient(
+	t *testing.T, address string, username string, password string,
+) *turn.Client {
+	t.Helper()
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: address,
+		TURNServerAddr: address,
+		Username:       username,
+		Password:       password,
+		Realm:          config.TURN_REALM,
+		Conn:           listenLocalUDP(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	err = client.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func readWithin(conn net.PacketConn, timeout time.Duration) (string, net.Addr) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, 1500)
+	n, addr, err := conn.ReadFrom(buffer)
+	if err != nil {
+		return "", nil
+	}
+	return string(buffer[:n]), addr
+}
+
+// only ice's port on the desktop can be reached through the relay
+func testTURNRelay(t *testing.T, username string, password string) {
+	ice := listenLocalUDP(t)
+	other := listenLocalUDP(t)
+
+	address := startTestTURN(t, ice.LocalAddr().(*net.UDPAddr).Port)
+	client := newTestTURNClient(t, address, username, password)
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	err = client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")})
+	if err == nil {
+		t.Error("allowed a peer that isnt the desktop")
+	}
+
+	_, err = relay.WriteTo([]byte("ice"), ice.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, from := readWithin(ice, 5*time.Second)
+	if data != "ice" {
+		t.Fatal("ice port didnt get the relayed packet")
+	}
+
+	_, err = relay.WriteTo([]byte("other"), other.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ = readWithin(other, 200*time.Millisecond)
+	if data != "" {
+		t.Error("relayed to a port that isnt ice's")
+	}
+
+	// and back again, but only from ice
+	other.WriteTo([]byte("other"), from)
+	ice.WriteTo([]byte("ice"), from)
+
+	data, _ = readWithin(relay, 5*time.Second)
+	if data != "ice" {
+		t.Errorf("expected only what ice sent, got %q", data)
+	}
+}
+
+func TestTURNStaticCredentials(t *testing.T) {
+	defaultUsername, defaultPassword := config.TURN_USERNAME, config.TURN_PASSWORD
+	t.Cleanup(func() {
+		config.TURN_USERNAME, config.TURN_PASSWORD = defaultUsername, defaultPassword
+	})
+	config.TURN_USERNAME, config.TURN_PASSWORD = "inu", "password"
+
+	t.Run("wrong password", func(t *testing.T) {
+		address := startTestTURN(t, 0)
+		client := newTestTURNClient(t, address, "inu", "wrong")
+
+		_, err := client.Allocate()
+		if err == nil {
+			t.Error("allocated with the wrong password")
+		}
+	})
+
+	t.Run("relay", func(t *testing.T) {
+		testTURNRelay(t, "inu", "password")
+	})
+}
+
+func TestTURNRESTCredentials(t *testing.T) {
+	defaultUsername, defaultSecret := config.TURN_USERNAME, turnSecret
+	t.Cleanup(func() {
+		config.TURN_USERNAME, turnSecret = defaultUsername, defaultSecret
+	})
+	config.TURN_USERNAME, turnSecret = "", "secret"
+
+	t.Run("expired", func(t *testing.T) {
+		username, password, err := turn.GenerateLongTermTURNRESTCredentials(
+			turnSecret, "inu", -time.Minute,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		address := startTestTURN(t, 0)
+		client := newTestTURNClient(t, address, username, password)
+
+		_, err = client.Allocate()
+		if err == nil {
+			t.Error("allocated with expired credentials")
+		}
+	})
+
+	t.Run("relay", func(t *testing.T) {
+		username, password, err := turn.GenerateLongTermTURNRESTCredentials(
+			turnSecret, "inu", time.Minute,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testTURNRelay(t, username, password)
+	})
+}
@@ -0,0 +1,383 @@
+package inuwebrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9725
+
+const (
+	sdpFragContentType = "application/trickle-ice-sdpfrag"
+
+	// browser offers are a few kilobytes
+	maxOfferSize = 64 * 1024
+)
+
+var (
+	// should be instant with nat1to1, unless something is wrong
+	gatherTimeout = 5 * time.Second
+
+	// replaced in tests, to gather forever
+	gatheringCompletePromise = webrtc.GatheringCompletePromise
+
+	errGatherTimeout = errors.New("ice gathering timed out")
+)
+
+type whepSession struct {
+	id   string
+	peer *webrtc.PeerConnection
+
+	// changes with every ice restart
+	mutex sync.Mutex
+	etag  string
+}
+
+// writes an error response if the request doesnt have a usable offer
+func readOffer(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/sdp" {
+		w.Header().Set("Accept-Post", "application/sdp")
+		http.Error(w, "expected application/sdp",
+			http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	offer, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "offer too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "failed to read offer", http.StatusBadRequest)
+		}
+		return nil, false
+	}
+
+	var description sdp.SessionDescription
+	err = description.Unmarshal(offer)
+	if err != nil || len(description.MediaDescriptions) == 0 {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return offer, true
+}
+
+func waitForGathering(ctx context.Context, gatherComplete <-chan struct{}) error {
+	select {
+	case <-gatherComplete:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(gatherTimeout):
+		return errGatherTimeout
+	}
+}
+
+// candidates and credentials from a sdp or sdpfrag
+type sdpFrag struct {
+	ufrag      string
+	pwd        string
+	candidates []webrtc.ICECandidateInit
+}
+
+var (
+	whepSessions      = map[string]*whepSession{}
+	whepSessionsMutex sync.Mutex
+)
+
+func randomID() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func newWHEPSession(peer *webrtc.PeerConnection) *whepSession {
+	session := &whepSession{
+		id:   randomID(),
+		peer: peer,
+		etag: randomID(),
+	}
+
+	whepSessionsMutex.Lock()
+	whepSessions[session.id] = session
+	whepSessionsMutex.Unlock()
+
+	return session
+}
+
+func getWHEPSession(id string) *whepSession {
+	whepSessionsMutex.Lock()
+	defer whepSessionsMutex.Unlock()
+	return whepSessions[id]
+}
+
+func (session *whepSession) remove() {
+	whepSessionsMutex.Lock()
+	delete(whepSessions, session.id)
+	whepSessionsMutex.Unlock()
+}
+
+func (session *whepSession) location() string {
+	return "/whep/session/" + session.id
+}
+
+// must be called with mutex locked
+func (session *whepSession) etagHeader() string {
+	return `"` + session.etag + `"`
+}
+
+// so players know which stun and turn servers to use
+func setICEServerLinks(w http.ResponseWriter) {
+	for _, server := range getICEServers() {
+		for _, url := range server.URLs {
+			link := "<" + url + `>; rel="ice-server"`
+			if server.Username != "" {
+				link += fmt.Sprintf(
+					`; username="%s"; credential="%v"; credential-type="password"`,
+					server.Username, server.Credential,
+				)
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+}
+
+func parseSDPFrag(frag string) sdpFrag {
+	var parsed sdpFrag
+
+	mid := ""
+	mLineIndex := -1
+
+	for line := range strings.Lines(frag) {
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mid = ""
+			mLineIndex++
+
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			parsed.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			parsed.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+			}
+			if mid != "" {
+				candidate.SDPMid = &mid
+			}
+			if mLineIndex >= 0 {
+				index := uint16(mLineIndex)
+				candidate.SDPMLineIndex = &index
+			}
+			parsed.candidates = append(parsed.candidates, candidate)
+		}
+	}
+
+	return parsed
+}
+
+// only the lines a sdpfrag needs
+func getSDPFrag(description string) string {
+	var frag strings.Builder
+
+	for line := range strings.Lines(description) {
+		line = strings.TrimRight(line, "\r\n")
+
+		for _, prefix := range []string{
+			"m=", "a=mid:", "a=ice-ufrag:", "a=ice-pwd:", "a=ice-options:",
+			"a=candidate:", "a=end-of-candidates",
+		} {
+			if strings.HasPrefix(line, prefix) {
+				frag.WriteString(line + "\r\n")
+				break
+			}
+		}
+	}
+
+	return frag.String()
+}
+
+func replaceICECredentials(description string, ufrag string, pwd string) string {
+	var replaced strings.Builder
+
+	for line := range strings.Lines(description) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag + "\r\n"
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd + "\r\n"
+		}
+		replaced.WriteString(line)
+	}
+
+	return replaced.String()
+}
+
+// must be called with mutex locked.
+// the client changed its credentials, so renegotiate with the same offer
+func (session *whepSession) restartICE(
+	ctx context.Context, frag sdpFrag,
+) (string, error) {
+	remote := session.peer.RemoteDescription()
+	if remote == nil {
+		return "", webrtc.ErrNoRemoteDescription
+	}
+
+	err := session.peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  replaceICECredentials(remote.SDP, frag.ufrag, frag.pwd),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, candidate := range frag.candidates {
+		session.peer.AddICECandidate(candidate)
+	}
+
+	gatherComplete := gatheringCompletePromise(session.peer)
+
+	answer, err := session.peer.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	err = session.peer.SetLocalDescription(answer)
+	if err != nil {
+		return "", err
+	}
+
+	err = waitForGathering(ctx, gatherComplete)
+	if err != nil {
+		return "", err
+	}
+
+	session.etag = randomID()
+
+	return getSDPFrag(session.peer.LocalDescription().SDP), nil
+}
+
+func whepSessionPatchHandler(w http.ResponseWriter, r *http.Request) {
+	session := getWHEPSession(r.PathValue("id"))
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != sdpFragContentType {
+		w.Header().Set("Accept-Patch", sdpFragContentType)
+		http.Error(w, "expected "+sdpFragContentType,
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 16384))
+	if err != nil {
+		http.Error(w, "failed to read sdpfrag", http.StatusBadRequest)
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	// restarts need * and trickle needs the current etag
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "missing If-Match", http.StatusPreconditionRequired)
+		return
+	}
+
+	frag := parseSDPFrag(string(body))
+
+	remote := session.peer.RemoteDescription()
+	current := sdpFrag{}
+	if remote != nil {
+		current = parseSDPFrag(remote.SDP)
+	}
+
+	restart := frag.ufrag != "" && frag.ufrag != current.ufrag
+
+	if (restart && ifMatch != "*") ||
+		(!restart && ifMatch != session.etagHeader()) {
+		http.Error(w, "ice session changed", http.StatusPreconditionFailed)
+		return
+	}
+
+	if restart {
+		answer, err := session.restartICE(r.Context(), frag)
+		if err != nil {
+			slog.Error("failed to restart ice", "err", err.Error())
+			status := http.StatusInternalServerError
+			if errors.Is(err, errGatherTimeout) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, "failed to restart ice", status)
+			return
+		}
+
+		w.Header().Set("Content-Type", sdpFragContentType)
+		w.Header().Set("ETag", session.etagHeader())
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, answer)
+		return
+	}
+
+	for _, candidate := range frag.candidates {
+		err := session.peer.AddICECandidate(candidate)
+		if err != nil {
+			http.Error(w, "invalid candidate", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func whepSessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	session := getWHEPSession(r.PathValue("id"))
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	session.remove()
+	session.peer.Close()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func whepSessionOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, PATCH, DELETE")
+	w.Header().Set("Accept-Patch", sdpFragContentType)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func whepOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, POST")
+	w.Header().Set("Accept-Post", "application/sdp")
+	setICEServerLinks(w)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,262 @@
+package inuwebrtc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func postOffer(contentType string, offer string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/whep", strings.NewReader(offer))
+	r.Header.Set("Content-Type", contentType)
+
+	w := httptest.NewRecorder()
+	whepHandler(w, r)
+
+	return w
+}
+
+func sessionRequest(
+	method string, location string, contentType string, body string,
+) *http.Request {
+	r := httptest.NewRequest(method, location, strings.NewReader(body))
+	r.SetPathValue("id", strings.TrimPrefix(location, "/whep/session/"))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	return r
+}
+
+func deleteSession(t *testing.T, location string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	whepSessionDeleteHandler(w, sessionRequest("DELETE", location, "", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete returned %d", w.Code)
+	}
+}
+
+func TestWHEPAnswer(t *testing.T) {
+	client := newTestClient(t, nil)
+
+	w := postOffer("application/sdp", newTestOffer(t, client))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w.Header().Get("Content-Type") != "application/sdp" {
+		t.Error("answer isnt application/sdp")
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Error("missing etag")
+	}
+	if w.Header().Get("Accept-Patch") != sdpFragContentType {
+		t.Error("missing accept patch")
+	}
+
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/whep/session/") {
+		t.Fatalf("unexpected location %q", location)
+	}
+
+	err := client.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  w.Body.String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connects over the host candidates from the mux
+	waitFor(t, "viewer to connect", func() bool {
+		return connectedPeers.count() == 1
+	})
+
+	deleteSession(t, location)
+	waitForPeersClosed(t)
+}
+
+func TestWHEPRejectsOffer(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		offer       string
+		status      int
+	}{
+		{"wrong content type", "text/plain", "v=0", http.StatusUnsupportedMediaType},
+		{"too large", "application/sdp", strings.Repeat("a", maxOfferSize+1),
+			http.StatusRequestEntityTooLarge},
+		{"not sdp", "application/sdp", "hello", http.StatusBadRequest},
+		{"no media", "application/sdp",
+			"v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n",
+			http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := postOffer(test.contentType, test.offer)
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, w.Code)
+			}
+
+			if test.status == http.StatusUnsupportedMediaType &&
+				w.Header().Get("Accept-Post") != "application/sdp" {
+				t.Error("missing accept post")
+			}
+
+			// rejected before a peer is made
+			if countWHEPSessions() != 0 || countStatsPeers() != 0 {
+				t.Error("peer was created")
+			}
+		})
+	}
+}
+
+func TestWHEPNoSupportedCodec(t *testing.T) {
+	mediaEngine := &webrtc.MediaEngine{}
+	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeVP8, ClockRate: 90000,
+		},
+		PayloadType: 96,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2,
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, mediaEngine)
+
+	w := postOffer("application/sdp", newTestOffer(t, client))
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("expected 406, got %d", w.Code)
+	}
+
+	if countWHEPSessions() != 0 || countStatsPeers() != 0 {
+		t.Error("peer was created")
+	}
+}
+
+func TestWHEPInvalidOfferClosesPeer(t *testing.T) {
+	client := newTestClient(t, nil)
+
+	// parses, but pion cant use it
+	offer := removeSDPLines(newTestOffer(t, client), "a=ice-ufrag:")
+
+	w := postOffer("application/sdp", offer)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	waitForPeersClosed(t)
+}
+
+func TestWHEPGatherTimeoutClosesPeer(t *testing.T) {
+	defaultTimeout, defaultPromise := gatherTimeout, gatheringCompletePromise
+	t.Cleanup(func() {
+		gatherTimeout, gatheringCompletePromise = defaultTimeout, defaultPromise
+	})
+
+	gatherTimeout = 50 * time.Millisecond
+	gatheringCompletePromise = func(*webrtc.PeerConnection) <-chan struct{} {
+		return make(chan struct{})
+	}
+
+	client := newTestClient(t, nil)
+
+	w := postOffer("application/sdp", newTestOffer(t, client))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+
+	waitForPeersClosed(t)
+}
+
+func TestWaitForGathering(t *testing.T) {
+	defaultTimeout := gatherTimeout
+	t.Cleanup(func() { gatherTimeout = defaultTimeout })
+	gatherTimeout = 50 * time.Millisecond
+
+	never := make(chan struct{})
+
+	err := waitForGathering(context.Background(), never)
+	if !errors.Is(err, errGatherTimeout) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = waitForGathering(ctx, never)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+
+	done := make(chan struct{})
+	close(done)
+
+	err = waitForGathering(context.Background(), done)
+	if err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestWHEPSessionPatch(t *testing.T) {
+	client := newTestClient(t, nil)
+
+	w := postOffer("application/sdp", newTestOffer(t, client))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+
+	location := w.Header().Get("Location")
+	etag := w.Header().Get("ETag")
+
+	// same credentials as the offer, so trickle
+	frag := getSDPFrag(client.LocalDescription().SDP)
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		status  int
+	}{
+		{"missing if match", "", http.StatusPreconditionRequired},
+		{"stale etag", `"stale"`, http.StatusPreconditionFailed},
+		{"wildcard without restart", "*", http.StatusPreconditionFailed},
+		{"trickle", etag, http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := sessionRequest("PATCH", location, sdpFragContentType, frag)
+			if test.ifMatch != "" {
+				r.Header.Set("If-Match", test.ifMatch)
+			}
+
+			w := httptest.NewRecorder()
+			whepSessionPatchHandler(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, w.Code)
+			}
+		})
+	}
+
+	deleteSession(t, location)
+	waitForPeersClosed(t)
+}
@@ -0,0 +1,193 @@
+package inuwebrtc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/pion/webrtc/v4"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9725
+
+var errWHIPDisconnected = errors.New("whip peer disconnected")
+
+func newWHIPRequest(
+	ctx context.Context, method string, url string, body []byte,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, method, url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/sdp")
+	}
+
+	if config.WHIP_TOKEN != "" {
+		req.Header.Set("Authorization", "Bearer "+config.WHIP_TOKEN)
+	}
+
+	return req, nil
+}
+
+// returns the session url
+func postWHIPOffer(
+	ctx context.Context, offer string,
+) (answer string, location string, err error) {
+	req, err := newWHIPRequest(ctx, "POST", config.WHIP_URL, []byte(offer))
+	if err != nil {
+		return "", "", err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxOfferSize))
+	if err != nil {
+		return "", "", err
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("whip server returned %s", res.Status)
+	}
+
+	endpoint, err := url.Parse(config.WHIP_URL)
+	if err != nil {
+		return "", "", err
+	}
+
+	resource, err := endpoint.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(body), resource.String(), nil
+}
+
+func deleteWHIPSession(location string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := newWHIPRequest(ctx, "DELETE", location, nil)
+	if err != nil {
+		return
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Warn("failed to delete whip session", "err", err.Error())
+		return
+	}
+	res.Body.Close()
+}
+
+// pushes the desktop to the whip server until the context is done.
+// counts as a viewer, so returns an error to be restarted when disconnected
+func RunWHIP(ctx context.Context) error {
+	peer, statsGetter, err := newPeerConnection()
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	addStatsPeer("", "", "whip", peer, statsGetter)
+	defer removeStatsPeer(peer)
+
+	// whip servers only have to take h264, so send the fallback when the
+	// desktop is anything else. it isnt closed when the codec changes
+	track, peers := videoTrack.Load(), &connectedPeers
+	if !sameCodec(track.Codec(), CodecH264) {
+		track, peers = fallbackVideoTrack, &fallbackPeers
+	}
+
+	disconnected := make(chan struct{})
+	closeDisconnected := sync.OnceFunc(func() { close(disconnected) })
+
+	peer.OnConnectionStateChange(func(connState webrtc.PeerConnectionState) {
+		slog.Info("whip " + connState.String())
+
+		switch connState {
+		case webrtc.PeerConnectionStateConnected:
+			peers.add(peer)
+			if !goLive(peer) {
+				KeyframeRequestSignal.Emit(context.Background(), track.keyframe)
+			}
+
+		case webrtc.PeerConnectionStateDisconnected,
+			webrtc.PeerConnectionStateFailed,
+			webrtc.PeerConnectionStateClosed:
+			peers.remove(peer)
+			closeDisconnected()
+		}
+	})
+
+	for _, localTrack := range []*rtpTrack{track, audioTrack} {
+		transceiver, err := peer.AddTransceiverFromTrack(
+			localTrack, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionSendonly,
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		go readRTCP(transceiver.Sender(), localTrack, func() {
+			KeyframeRequestSignal.Emit(context.Background(), localTrack.keyframe)
+		})
+	}
+
+	gatherComplete := gatheringCompletePromise(peer)
+
+	offer, err := peer.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	err = peer.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+
+	err = waitForGathering(ctx, gatherComplete)
+	if err != nil {
+		return err
+	}
+
+	answer, location, err := postWHIPOffer(ctx, peer.LocalDescription().SDP)
+	if err != nil {
+		return err
+	}
+
+	defer deleteWHIPSession(location)
+
+	err = peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("whip session created", "location", location)
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-disconnected:
+		return errWHIPDisconnected
+	}
+}
@@ -0,0 +1,196 @@
+package inuwebrtc
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// a whip server made from a pion peer with its default codecs
+type whipStandIn struct {
+	t      *testing.T
+	server *httptest.Server
+	peer   *webrtc.PeerConnection
+
+	videoCodecs chan string
+	deleted     chan struct{}
+}
+
+func newWHIPStandIn(t *testing.T) *whipStandIn {
+	standIn := &whipStandIn{
+		t:           t,
+		videoCodecs: make(chan string, 1),
+		deleted:     make(chan struct{}, 1),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /whip", standIn.post)
+	mux.HandleFunc("DELETE /whip/session", func(w http.ResponseWriter, r *http.Request) {
+		standIn.deleted <- struct{}{}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	standIn.server = httptest.NewServer(mux)
+	t.Cleanup(standIn.server.Close)
+
+	return standIn
+}
+
+func (standIn *whipStandIn) post(w http.ResponseWriter, r *http.Request) {
+	offer, _ := io.ReadAll(r.Body)
+
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	standIn.peer = peer
+	standIn.t.Cleanup(func() { peer.Close() })
+
+	peer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			standIn.videoCodecs <- track.Codec().MimeType
+		}
+	})
+
+	err = peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peer)
+
+	answer, err := peer.CreateAnswer(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = peer.SetLocalDescription(answer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	<-gatherComplete
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/session")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, peer.LocalDescription().SDP)
+}
+
+// idr slices until stopped, enough for the stand in to see the track
+func writeTestH264(ctx context.Context, write func(packet []byte)) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for seq := uint16(0); ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         true,
+				PayloadType:    96,
+				SequenceNumber: seq,
+				Timestamp:      uint32(seq) * 3000,
+				SSRC:           1234,
+			},
+			Payload: []byte{0x65, 0x88, 0x84, 0x00},
+		}
+
+		data, err := packet.Marshal()
+		if err == nil {
+			write(data)
+		}
+	}
+}
+
+func TestWHIPSendsFallbackVideo(t *testing.T) {
+	standIn := newWHIPStandIn(t)
+
+	defaultURL := config.WHIP_URL
+	t.Cleanup(func() {
+		config.WHIP_URL = defaultURL
+		SetVideoCodec(CodecH264)
+	})
+	config.WHIP_URL = standIn.server.URL + "/whip"
+
+	// whip servers arent expected to take this
+	SetVideoCodec(CodecVP9Profile1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	whipErr := make(chan error, 1)
+	go func() {
+		whipErr <- RunWHIP(ctx)
+	}()
+
+	waitFor(t, "whip to connect", func() bool {
+		return fallbackPeers.count() == 1
+	})
+
+	if connectedPeers.count() != 0 {
+		t.Error("whip counted as a desktop viewer")
+	}
+
+	go writeTestH264(ctx, WriteFallbackVideoRTP)
+
+	select {
+	case mimeType := <-standIn.videoCodecs:
+		if mimeType != webrtc.MimeTypeH264 {
+			t.Errorf("expected h264, got %s", mimeType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stand in never got video")
+	}
+
+	// only desktop viewers renegotiate
+	SetVideoCodec(CodecH264High444)
+
+	select {
+	case err := <-whipErr:
+		t.Fatalf("whip stopped on codec change: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if fallbackPeers.count() != 1 {
+		t.Error("whip was dropped on codec change")
+	}
+
+	cancel()
+
+	select {
+	case err := <-whipErr:
+		if err != nil {
+			t.Errorf("expected nil, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("whip didnt stop")
+	}
+
+	select {
+	case <-standIn.deleted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("whip session wasnt deleted")
+	}
+
+	waitForPeersClosed(t)
+}
@@ -0,0 +1,174 @@
+package inuwebrtc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/maniartech/signals"
+)
+
+// a single window captured on its own, shared by everyone watching it
+type windowStream struct {
+	xid        uint32
+	videoTrack *rtpTrack
+	peers      peerList
+
+	// peers that havent closed yet, including ones reconnecting after an
+	// ice restart. the stream and its pipeline go away together at 0
+	sessions int
+	// pipeline has been asked for
+	active bool
+}
+
+type WindowStream struct {
+	XID uint32
+	// for rtp packets from the pipeline
+	Write func(packet []byte)
+	// false once every peer has closed
+	Active bool
+}
+
+var (
+	windowStreams = map[uint32]*windowStream{}
+	// held whilst emitting, so a stream's pipeline is removed
+	// before a new one for the same window is added
+	windowStreamsMutex sync.Mutex
+
+	WindowStreamSignal = signals.New[WindowStream]()
+
+	// so only windows that exist get a pipeline
+	windowChecker atomic.Pointer[func(xid uint32) bool]
+)
+
+func SetWindowChecker(check func(xid uint32) bool) {
+	windowChecker.Store(&check)
+}
+
+func isWindow(xid uint32) bool {
+	check := windowChecker.Load()
+	return check != nil && (*check)(xid)
+}
+
+// must be called with mutex locked
+func (stream *windowStream) emit() {
+	WindowStreamSignal.Emit(context.Background(), WindowStream{
+		XID:    stream.xid,
+		Write:  stream.write,
+		Active: stream.active,
+	})
+}
+
+// starts the pipeline once someone is actually watching
+func (stream *windowStream) onViewersChanged() {
+	windowStreamsMutex.Lock()
+	defer windowStreamsMutex.Unlock()
+
+	if stream.active || stream.peers.count() == 0 ||
+		windowStreams[stream.xid] != stream {
+		return
+	}
+
+	stream.active = true
+	stream.emit()
+}
+
+// once for every acquire, when the peer has closed
+func (stream *windowStream) release() {
+	windowStreamsMutex.Lock()
+	defer windowStreamsMutex.Unlock()
+
+	stream.sessions--
+	if stream.sessions > 0 {
+		return
+	}
+
+	delete(windowStreams, stream.xid)
+
+	slog.Info("window stream removed", "xid", stream.xid)
+
+	if stream.active {
+		stream.active = false
+		stream.emit()
+	}
+}
+
+func (stream *windowStream) write(packet []byte) {
+	stream.videoTrack.writeRTP(packet)
+}
+
+// release once the peer has closed
+func acquireWindowStream(xid uint32) *windowStream {
+	windowStreamsMutex.Lock()
+	defer windowStreamsMutex.Unlock()
+
+	stream, exists := windowStreams[xid]
+	if exists {
+		stream.sessions++
+		return stream
+	}
+
+	stream = &windowStream{
+		xid: xid,
+		videoTrack: newRTPTrack(
+			CodecH264, "video", fmt.Sprintf("inu-window-%d", xid),
+			KeyframeRequest{XID: xid},
+		),
+		sessions: 1,
+	}
+
+	stream.peers.onChange = stream.onViewersChanged
+
+	windowStreams[xid] = stream
+
+	slog.Info("window stream created", "xid", xid)
+
+	return stream
+}
+
+// for windows that have gone away
+func CloseWindowStream(xid uint32) {
+	windowStreamsMutex.Lock()
+	stream, exists := windowStreams[xid]
+	windowStreamsMutex.Unlock()
+
+	if exists {
+		stream.peers.closeAll()
+	}
+}
+
+// video only since audio cant be limited to a window
+func whepWindowHandler(w http.ResponseWriter, r *http.Request) {
+	xid, err := strconv.ParseUint(r.PathValue("id"), 0, 32)
+	if err != nil {
+		http.Error(w, "invalid window id", http.StatusBadRequest)
+		return
+	}
+
+	if !isWindow(uint32(xid)) {
+		http.Error(w, "window not found", http.StatusNotFound)
+		return
+	}
+
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	if !offerSupports(offer, CodecH264) {
+		http.Error(w, "offer has no supported video codec",
+			http.StatusNotAcceptable)
+		return
+	}
+
+	stream := acquireWindowStream(uint32(xid))
+
+	servePeer(
+		w, r, offer, &stream.peers, []*rtpTrack{stream.videoTrack},
+		stream.videoTrack.keyframe, stream.release,
+	)
+}
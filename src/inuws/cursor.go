@@ -0,0 +1,140 @@
+package inuws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/x11"
+)
+
+var (
+	// drawn into the video, so clients shouldnt draw their own
+	pointerInVideo atomic.Bool
+
+	currentCursor      *x11.Cursor
+	currentCursorX     int
+	currentCursorY     int
+	currentCursorMutex sync.RWMutex
+)
+
+func sendPointerInVideo(c *client, value bool) {
+	data := []byte{WSEventPointerInVideo, 0}
+	if value {
+		data[1] = 1
+	}
+	c.writeMessage(data)
+}
+
+func SetPointerInVideo(value bool) {
+	if pointerInVideo.Swap(value) == value {
+		return
+	}
+
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	for _, c := range clients {
+		sendPointerInVideo(c, value)
+	}
+}
+
+func sendCursor(c *client, cursor *x11.Cursor) {
+	// clients cache images by serial so only send it once
+	c.cursorMutex.Lock()
+	_, sent := c.sentCursors[cursor.Serial]
+	c.sentCursors[cursor.Serial] = struct{}{}
+	c.cursorMutex.Unlock()
+
+	buf := bytes.NewBuffer(nil)
+
+	if sent {
+		buf.WriteByte(WSEventCursorShape)
+		binary.Write(buf, binary.LittleEndian, cursor.Serial)
+		c.writeMessage(buf.Bytes())
+		return
+	}
+
+	buf.WriteByte(WSEventCursorImage)
+	binary.Write(buf, binary.LittleEndian, cursor.Serial)
+	binary.Write(buf, binary.LittleEndian, []uint16{
+		uint16(cursor.Width), uint16(cursor.Height),
+		uint16(cursor.XHot), uint16(cursor.YHot),
+	})
+	buf.Write(cursor.RGBA)
+
+	c.writeMessage(buf.Bytes())
+}
+
+func sendCursorPosition(c *client, x int, y int) {
+	bounds, ok := c.getBounds()
+	if !ok {
+		return
+	}
+
+	// normalized like incoming mouse moves
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(WSEventCursorPosition)
+	binary.Write(buf, binary.LittleEndian, []float32{
+		float32(x-bounds.X) / float32(bounds.Width),
+		float32(y-bounds.Y) / float32(bounds.Height),
+	})
+	c.writeMessage(buf.Bytes())
+}
+
+func sendCurrentCursor(c *client) {
+	currentCursorMutex.RLock()
+	cursor := currentCursor
+	x, y := currentCursorX, currentCursorY
+	currentCursorMutex.RUnlock()
+
+	if cursor == nil {
+		return
+	}
+
+	sendCursor(c, cursor)
+	sendCursorPosition(c, x, y)
+}
+
+func onCursorImage(cursor x11.Cursor) {
+	currentCursorMutex.Lock()
+	currentCursor = &cursor
+	currentCursorMutex.Unlock()
+
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	for _, c := range clients {
+		sendCursor(c, &cursor)
+	}
+}
+
+func onCursorPosition(x int, y int) {
+	currentCursorMutex.Lock()
+	currentCursorX, currentCursorY = x, y
+	currentCursorMutex.Unlock()
+
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	for _, c := range clients {
+		sendCursorPosition(c, x, y)
+	}
+}
+
+func watchCursor() {
+	for {
+		err := x11.WatchCursor(
+			config.FRAMERATE, onCursorImage, onCursorPosition,
+		)
+		if err != nil {
+			slog.Error("cursor", "err", err.Error())
+		}
+		// display might not be ready yet
+		time.Sleep(time.Second * 5)
+	}
+}
@@ -3,12 +3,16 @@ package inuws
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"log/slog"
 	"net/http"
 	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/makinori/inu-desktop/src/config"
@@ -16,13 +20,90 @@ import (
 	"github.com/maniartech/signals"
 )
 
+type client struct {
+	conn *websocket.Conn
+	// issued on connect, sent back with the whep offer
+	session    string
+	writeMutex sync.Mutex
+
+	sentCursors map[uint32]struct{}
+	cursorMutex sync.Mutex
+
+	// input is limited to this window if set,
+	// when the session's peer is watching one
+	window        atomic.Uint32
+	geometry      x11.Geometry
+	geometryOK    bool
+	geometryTime  time.Time
+	geometryMutex sync.Mutex
+}
+
+// screen area the client is viewing
+func (c *client) getBounds() (x11.Geometry, bool) {
+	window := c.window.Load()
+	if window == 0 {
+		return x11.Geometry{
+			Width: config.SCREEN_WIDTH, Height: config.SCREEN_HEIGHT,
+		}, true
+	}
+
+	c.geometryMutex.Lock()
+	defer c.geometryMutex.Unlock()
+
+	// cached since mouse moves come in fast
+	if time.Since(c.geometryTime) > time.Millisecond*500 {
+		c.geometry, c.geometryOK = x11.GetWindowGeometry(window)
+		c.geometryTime = time.Now()
+	}
+
+	return c.geometry, c.geometryOK
+}
+
+func (c *client) setWindow(window uint32) {
+	c.geometryMutex.Lock()
+	defer c.geometryMutex.Unlock()
+
+	c.window.Store(window)
+	c.geometryTime = time.Time{}
+}
+
+func (c *client) mouseInBounds() bool {
+	if c.window.Load() == 0 {
+		return true
+	}
+
+	bounds, ok := c.getBounds()
+	if !ok {
+		return false
+	}
+
+	x, y, ok := x11.GetMousePos()
+	return ok && bounds.Contains(x, y)
+}
+
+func (c *client) writeMessage(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
 var (
 	upgrader websocket.Upgrader
 
-	conns      []*websocket.Conn
-	connsMutex sync.RWMutex
+	clients      []*client
+	clientsMutex sync.RWMutex
+
+	// last client to send input
+	controller *client
 
 	viewerCount *atomic.Uint32
+
+	// emits the session of the client holding control, empty if nobody
+	ControllerSignal = signals.New[string]()
+
+	// emits the window the client is viewing, 0 for the desktop.
+	// usually happens before the whep offer
+	ClientConnectedSignal = signals.New[uint32]()
 )
 
 const (
@@ -33,9 +114,16 @@ const (
 	WSEventClipboardUpload
 	WSEventClipboardDownload
 	WSEventViewerCount
+	WSEventControl
+	WSEventCursorImage
+	WSEventCursorShape
+	WSEventCursorPosition
+	WSEventPeerStats
+	WSEventSession
+	WSEventPointerInVideo
 )
 
-func getMousePos(buf *bytes.Buffer) (int, int, bool) {
+func getMousePos(c *client, buf *bytes.Buffer) (int, int, bool) {
 	var x, y float32
 
 	err := binary.Read(buf, binary.LittleEndian, &x)
@@ -48,10 +136,15 @@ func getMousePos(buf *bytes.Buffer) (int, int, bool) {
 		return 0, 0, false
 	}
 
-	xInt := int(x * float32(config.SCREEN_WIDTH))
-	yInt := int(y * float32(config.SCREEN_HEIGHT))
+	bounds, ok := c.getBounds()
+	if !ok {
+		return 0, 0, false
+	}
 
-	if xInt < 0 || yInt < 0 ||
+	xInt := bounds.X + int(x*float32(bounds.Width))
+	yInt := bounds.Y + int(y*float32(bounds.Height))
+
+	if !bounds.Contains(xInt, yInt) ||
 		xInt >= config.SCREEN_WIDTH || yInt >= config.SCREEN_HEIGHT {
 		return 0, 0, false
 	}
@@ -59,19 +152,82 @@ func getMousePos(buf *bytes.Buffer) (int, int, bool) {
 	return xInt, yInt, true
 }
 
-func handleMessage(conn *websocket.Conn, buf *bytes.Buffer) {
+func sendControlMessage(c *client, hasControl bool) {
+	var value byte
+	if hasControl {
+		value = 1
+	}
+	c.writeMessage([]byte{WSEventControl, value})
+}
+
+// returns true if changed. must be called with clientsMutex locked
+func setController(c *client) bool {
+	if controller == c {
+		return false
+	}
+
+	if controller != nil {
+		sendControlMessage(controller, false)
+	}
+
+	controller = c
+
+	if controller != nil {
+		sendControlMessage(controller, true)
+	}
+
+	return true
+}
+
+func emitController() {
+	clientsMutex.RLock()
+	session := ""
+	if controller != nil {
+		session = controller.session
+	}
+	clientsMutex.RUnlock()
+
+	ControllerSignal.Emit(context.Background(), session)
+}
+
+func takeControl(c *client) {
+	clientsMutex.RLock()
+	isController := controller == c
+	clientsMutex.RUnlock()
+
+	if isController {
+		return
+	}
+
+	clientsMutex.Lock()
+	changed := setController(c)
+	clientsMutex.Unlock()
+
+	if changed {
+		emitController()
+	}
+}
+
+func handleMessage(c *client, buf *bytes.Buffer) {
 	eventType, err := buf.ReadByte()
 	if err != nil {
 		return
 	}
 
+	countInputEvent(eventType)
+
+	switch eventType {
+	case WSEventMouseMove, WSEventMouseClick, WSEventKeyPress, WSEventScroll:
+		takeControl(c)
+	}
+
 	switch eventType {
 	case WSEventMouseMove:
 		if !config.IN_CONTAINER {
 			return
 		}
 
-		x, y, ok := getMousePos(buf)
+		x, y, ok := getMousePos(c, buf)
 		if !ok {
 			return
 		}
@@ -93,6 +249,11 @@ func handleMessage(conn *websocket.Conn, buf *bytes.Buffer) {
 			return
 		}
 
+		// always let go so buttons dont get stuck
+		if down == 1 && !c.mouseInBounds() {
+			return
+		}
+
 		x11.ClickMouse(jsButton, down)
 
 	case WSEventKeyPress:
@@ -111,6 +272,11 @@ func handleMessage(conn *websocket.Conn, buf *bytes.Buffer) {
 			return
 		}
 
+		window := c.window.Load()
+		if window != 0 {
+			x11.FocusWindow(window)
+		}
+
 		x11.KeyPress(keysym, down)
 
 	case WSEventScroll:
@@ -123,6 +289,10 @@ func handleMessage(conn *websocket.Conn, buf *bytes.Buffer) {
 			return
 		}
 
+		if !c.mouseInBounds() {
+			return
+		}
+
 		x11.ScrollMouse(scrollDown == 1)
 
 	case WSEventClipboardUpload:
@@ -134,28 +304,125 @@ func handleMessage(conn *websocket.Conn, buf *bytes.Buffer) {
 			return
 		}
 
-		conn.WriteMessage(websocket.BinaryMessage, append([]byte{
-			WSEventClipboardDownload,
-		}, value...))
+		c.writeMessage(append([]byte{WSEventClipboardDownload}, value...))
+
+	}
+}
+
+func getClient(session string) *client {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	index := slices.IndexFunc(clients, func(c *client) bool {
+		return c.session == session
+	})
+	if index < 0 {
+		return nil
+	}
+
+	return clients[index]
+}
+
+// input from a webrtc data channel. replies still go over the websocket
+func HandleInput(session string, message []byte) {
+	c := getClient(session)
+	if c == nil {
+		return
+	}
+
+	handleMessage(c, bytes.NewBuffer(message))
+}
 
+// json stats of the session's own peers
+func SendPeerStats(session string, data []byte) {
+	c := getClient(session)
+	if c == nil {
+		return
 	}
+
+	c.writeMessage(append([]byte{WSEventPeerStats}, data...))
 }
 
-func sendViewerCountMessage(conn *websocket.Conn, value uint32) {
+// links a peer to the connected client it was issued to. once a peer is
+// watching a window, the client's input is limited to it.
+// false if no client has the session
+func JoinSession(session string, window uint32) bool {
+	if session == "" {
+		return false
+	}
+
+	c := getClient(session)
+	if c == nil {
+		return false
+	}
+
+	if window != 0 {
+		c.setWindow(window)
+	}
+
+	return true
+}
+
+func newSession() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func sendViewerCountMessage(c *client, value uint32) {
 	buf := bytes.NewBuffer(nil)
 	buf.WriteByte(WSEventViewerCount)
 	binary.Write(buf, binary.LittleEndian, value)
-	conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+	c.writeMessage(buf.Bytes())
+}
+
+func onConnected(c *client) {
+	c.writeMessage(append([]byte{WSEventSession}, c.session...))
+	sendViewerCountMessage(c, viewerCount.Load())
+	sendControlMessage(c, false)
+	sendPointerInVideo(c, pointerInVideo.Load())
+	sendCurrentCursor(c)
 }
 
-func onConnected(conn *websocket.Conn) {
-	sendViewerCountMessage(conn, viewerCount.Load())
+func onDisconnected(c *client) {
+	clientsMutex.Lock()
+	changed := controller == c && setController(nil)
+	clientsMutex.Unlock()
+
+	if changed {
+		emitController()
+	}
 }
 
-func onDisconnected(conn *websocket.Conn) {
+func removeClient(c *client) {
+	clientsMutex.Lock()
+	i := slices.Index(clients, c)
+	if i < 0 {
+		clientsMutex.Unlock()
+		return
+	}
+	clients = slices.Delete(clients, i, i+1)
+	clientsMutex.Unlock()
+
+	onDisconnected(c)
 }
 
 func handleEndpoint(w http.ResponseWriter, r *http.Request) {
+	var window uint64
+	if r.URL.Query().Has("window") {
+		var err error
+		window, err = strconv.ParseUint(r.URL.Query().Get("window"), 0, 32)
+		if err != nil || window == 0 {
+			http.Error(w, "invalid window id", http.StatusBadRequest)
+			return
+		}
+
+		if config.IN_CONTAINER && !x11.IsClientWindow(uint32(window)) {
+			http.Error(w, "window not found", http.StatusNotFound)
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -163,27 +430,25 @@ func handleEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	connsMutex.Lock()
-	conns = append(conns, conn)
-	connsMutex.Unlock()
-
-	conn.SetCloseHandler(func(_ int, _ string) error {
-		connsMutex.Lock()
-		defer connsMutex.Unlock()
+	c := &client{
+		conn:        conn,
+		session:     newSession(),
+		sentCursors: map[uint32]struct{}{},
+	}
 
-		i := slices.Index(conns, conn)
-		if i < 0 {
-			return nil
-		}
+	// the whep offer sets it too, but prewarming needs it now
+	c.window.Store(uint32(window))
 
-		conns = slices.Delete(conns, i, i+1)
+	clientsMutex.Lock()
+	clients = append(clients, c)
+	clientsMutex.Unlock()
 
-		onDisconnected(conn)
+	// close handler isnt called when the connection just drops
+	defer removeClient(c)
 
-		return nil
-	})
+	onConnected(c)
 
-	onConnected(conn)
+	ClientConnectedSignal.Emit(context.Background(), c.window.Load())
 
 	// TODO: limit by framerate
 
@@ -201,16 +466,16 @@ func handleEndpoint(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		handleMessage(conn, bytes.NewBuffer(message))
+		handleMessage(c, bytes.NewBuffer(message))
 	}
 }
 
 func onViewerCountChanged(value uint32) {
-	connsMutex.RLock()
-	defer connsMutex.RUnlock()
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
 
-	for _, conn := range conns {
-		sendViewerCountMessage(conn, value)
+	for _, c := range clients {
+		sendViewerCountMessage(c, value)
 	}
 }
 
@@ -223,6 +488,10 @@ func Init(
 
 	viewerCount = viewerCountPtr
 
+	if config.IN_CONTAINER {
+		go watchCursor()
+	}
+
 	viewerCountSignal.AddListener(func(_ context.Context, value uint32) {
 		onViewerCountChanged(value)
 	})
@@ -0,0 +1,38 @@
+package inuws
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	inputEventNames = map[byte]string{
+		WSEventMouseMove:         "mouse_move",
+		WSEventMouseClick:        "mouse_click",
+		WSEventKeyPress:          "key_press",
+		WSEventScroll:            "scroll",
+		WSEventClipboardUpload:   "clipboard_upload",
+		WSEventClipboardDownload: "clipboard_download",
+	}
+
+	inputEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inu_input_events_total",
+		Help: "Input events from clients, over the websocket or data channels.",
+	}, []string{"type"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "inu_websocket_connections",
+		Help: "Connected websocket clients.",
+	}, func() float64 {
+		clientsMutex.RLock()
+		defer clientsMutex.RUnlock()
+		return float64(len(clients))
+	})
+)
+
+func countInputEvent(eventType byte) {
+	name, ok := inputEventNames[eventType]
+	if ok {
+		inputEvents.WithLabelValues(name).Inc()
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"embed"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/makinori/inu-desktop/src/config"
 	"github.com/makinori/inu-desktop/src/inuwebrtc"
 	"github.com/makinori/inu-desktop/src/inuws"
 	"github.com/makinori/inu-desktop/src/supervisor"
+	"github.com/makinori/inu-desktop/src/x11"
 )
 
 var (
@@ -31,6 +35,10 @@ func Main() {
 
 	inuws.Init(httpMux, &inuwebrtc.ViewerCount, inuwebrtc.ViewerCountSignal)
 
+	inuwebrtc.SetInputHandler(inuws.HandleInput)
+	inuwebrtc.SetSessionHandler(inuws.JoinSession)
+	inuwebrtc.SetWindowChecker(x11.IsClientWindow)
+
 	initWeb(httpMux)
 
 	processes.AddSimple("http", func() error {
@@ -38,7 +46,13 @@ func Main() {
 			"public http listening at " + strconv.Itoa(config.WEB_PORT),
 		)
 
-		err := http.ListenAndServe(":"+strconv.Itoa(config.WEB_PORT), httpMux)
+		var err error
+		if inuwebrtc.WebListener != nil {
+			// ice-tcp is on the same port
+			err = http.Serve(inuwebrtc.WebListener, httpMux)
+		} else {
+			err = http.ListenAndServe(":"+strconv.Itoa(config.WEB_PORT), httpMux)
+		}
 		if err != nil {
 			slog.Error(err.Error())
 		}
@@ -50,19 +64,61 @@ func Main() {
 		initDesktop()
 	}
 
-	initGStreamer()
+	initStream(httpMux)
+
+	initFramerate(httpMux)
+
+	initWindows(httpMux)
+
+	initGStreamer(httpMux)
+
+	initHLS(httpMux)
+
+	initPush(httpMux)
+
+	initRecordings(httpMux)
+
+	initReplay(httpMux)
 
-	inuwebrtc.ViewerCountSignal.AddListener(
-		func(ctx context.Context, value uint32) {
-			if value == 0 {
-				processes.Stop("gst-video")
-				processes.Stop("gst-audio")
+	initAdmin(httpMux)
+
+	initStats(httpMux)
+
+	initMetrics(httpMux)
+
+	initController(httpMux)
+
+	if config.WHIP_URL != "" {
+		processes.AddFunc(supervisor.Func{
+			ID:  "whip",
+			Run: inuwebrtc.RunWHIP,
+		})
+	}
+
+	// only whoever has control can talk into the desktop
+	inuws.ControllerSignal.AddListener(
+		func(ctx context.Context, session string) {
+			inuwebrtc.SetMicSession(session)
+			if session == "" {
+				setMicMuted(true)
+				processes.Stop("gst-mic")
 			} else {
-				processes.Start("gst-video")
-				processes.Start("gst-audio")
+				setMicMuted(false)
+				processes.Start("gst-mic")
 			}
 		},
 	)
 
+	// let recordings finish writing before exiting
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+
+		slog.Info("shutting down...")
+		stopRecording()
+		os.Exit(0)
+	}()
+
 	processes.Run()
 }
@@ -0,0 +1,130 @@
+package src
+
+import (
+	"net/http"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prometheus metrics for dashboards across instances.
+// needs the admin token if there is one
+
+type processCollector struct{}
+
+// what the pipelines actually put out, rather than their targets
+type rtpSinkCollector struct{}
+
+var (
+	processRunningDesc = prometheus.NewDesc(
+		"inu_process_running",
+		"Whether the supervised process is meant to be running.",
+		[]string{"id"}, nil,
+	)
+	processRestartsDesc = prometheus.NewDesc(
+		"inu_process_restarts_total",
+		"Times the supervised process exited or was restarted while running.",
+		[]string{"id"}, nil,
+	)
+	processFailuresDesc = prometheus.NewDesc(
+		"inu_process_failures",
+		"Failures in a row of the supervised process.",
+		[]string{"id"}, nil,
+	)
+
+	rtpSinkPacketsDesc = prometheus.NewDesc(
+		"inu_rtp_sink_packets_total",
+		"Packets out of the pipeline's rtp sink, all windows as one.",
+		[]string{"sink"}, nil,
+	)
+	rtpSinkBytesDesc = prometheus.NewDesc(
+		"inu_rtp_sink_bytes_total",
+		"Bytes out of the pipeline's rtp sink, all windows as one, including rtp headers.",
+		[]string{"sink"}, nil,
+	)
+)
+
+func (processCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- processRunningDesc
+	ch <- processRestartsDesc
+	ch <- processFailuresDesc
+}
+
+func (processCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, process := range processes.Status() {
+		running := 0.0
+		if process.Running {
+			running = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			processRunningDesc, prometheus.GaugeValue, running, process.ID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			processRestartsDesc, prometheus.CounterValue,
+			float64(process.Restarts), process.ID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			processFailuresDesc, prometheus.GaugeValue,
+			float64(process.Failures), process.ID,
+		)
+	}
+}
+
+func (rtpSinkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rtpSinkPacketsDesc
+	ch <- rtpSinkBytesDesc
+}
+
+func (rtpSinkCollector) Collect(ch chan<- prometheus.Metric) {
+	rtpSinkStatsMutex.RLock()
+	defer rtpSinkStatsMutex.RUnlock()
+
+	for name, stats := range rtpSinkStats {
+		ch <- prometheus.MustNewConstMetric(
+			rtpSinkPacketsDesc, prometheus.CounterValue,
+			float64(stats.Packets.Load()), name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			rtpSinkBytesDesc, prometheus.CounterValue,
+			float64(stats.Bytes.Load()), name,
+		)
+	}
+}
+
+func metricsHandler() http.HandlerFunc {
+	handler := promhttp.Handler()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.ADMIN_TOKEN != "" && !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}
+}
+
+func initMetrics(httpMux *http.ServeMux) {
+	prometheus.MustRegister(
+		processCollector{},
+		rtpSinkCollector{},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "inu_encoder_video_bitrate_bits",
+			Help: "Target bitrate of the desktop video encoder, " +
+				"use rate of inu_rtp_sink_bytes_total for the actual.",
+		}, func() float64 {
+			return float64(getStreamSettings().VideoBitrate) * 1000
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "inu_encoder_audio_bitrate_bits",
+			Help: "Target bitrate of the desktop audio encoder.",
+		}, func() float64 {
+			return float64(getStreamSettings().AudioBitrate)
+		}),
+	)
+
+	httpMux.HandleFunc("GET /metrics", metricsHandler())
+}
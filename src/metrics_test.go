@@ -0,0 +1,82 @@
+package src
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func getSinkCounter(
+	t *testing.T, registry *prometheus.Registry, name string, sink string,
+) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "sink" && label.GetValue() == sink {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	t.Fatalf("no %s for %s", name, sink)
+	return 0
+}
+
+func TestRTPSinkCounters(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(rtpSinkCollector{})
+
+	write := countRTP("test", func([]byte) {})
+	write(make([]byte, 1200))
+	write(make([]byte, 300))
+
+	packets := getSinkCounter(t, registry, "inu_rtp_sink_packets_total", "test")
+	if packets != 2 {
+		t.Errorf("expected 2 packets, got %v", packets)
+	}
+
+	bytes := getSinkCounter(t, registry, "inu_rtp_sink_bytes_total", "test")
+	if bytes != 1500 {
+		t.Errorf("expected 1500 bytes, got %v", bytes)
+	}
+}
+
+func TestRTPSinkCountersShareWindows(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(rtpSinkCollector{})
+
+	before := 0.0
+	rtpSinkStatsMutex.RLock()
+	if stats, exists := rtpSinkStats["window"]; exists {
+		before = float64(stats.Packets.Load())
+	}
+	rtpSinkStatsMutex.RUnlock()
+
+	countRTP(getWindowProcessID(1), func([]byte) {})(make([]byte, 100))
+	countRTP(getWindowProcessID(2), func([]byte) {})(make([]byte, 100))
+
+	packets := getSinkCounter(t, registry, "inu_rtp_sink_packets_total", "window")
+	if packets-before != 2 {
+		t.Errorf("expected 2 window packets, got %v", packets-before)
+	}
+
+	rtpSinkStatsMutex.RLock()
+	defer rtpSinkStatsMutex.RUnlock()
+	for name := range rtpSinkStats {
+		if strings.HasPrefix(name, "gst-window-") {
+			t.Errorf("window has its own entry %s", name)
+		}
+	}
+}
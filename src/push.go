@@ -0,0 +1,271 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// pushes the desktop to a streaming service. reuses the webrtc video encode,
+// audio has to be aac for flv so that's encoded again
+
+type pushTarget struct {
+	// rtmp://, rtmps:// or srt://
+	URL       string `json:"url"`
+	StreamKey string `json:"streamKey"`
+}
+
+type pushStatus struct {
+	Active bool   `json:"active"`
+	URL    string `json:"url,omitempty"`
+	// of the process
+	Running   bool   `json:"running"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+var (
+	push      *pushTarget
+	pushMutex sync.Mutex
+	// which video pipeline is being tapped and held
+	pushVideo string
+)
+
+// both end up quoted in the pipeline and under gst-launch in a shell too
+func isSafeForPipeline(value string) bool {
+	for _, char := range value {
+		if char <= ' ' || char == 0x7f || strings.ContainsRune(`"'!$`+"`", char) {
+			return false
+		}
+	}
+	return true
+}
+
+func (target pushTarget) validate() error {
+	if !isSafeForPipeline(target.URL) || !isSafeForPipeline(target.StreamKey) {
+		return fmt.Errorf("url and stream key cant contain quotes, !, $, ` or whitespace")
+	}
+
+	parsed, err := url.Parse(target.URL)
+	if err != nil {
+		return err
+	}
+
+	switch parsed.Scheme {
+	case "rtmp", "rtmps", "srt":
+		return nil
+	}
+
+	return fmt.Errorf("url must be rtmp://, rtmps:// or srt://")
+}
+
+func (target pushTarget) getSink() string {
+	if strings.HasPrefix(target.URL, "srt://") {
+		uri := target.URL
+		if target.StreamKey != "" {
+			parsed, _ := url.Parse(target.URL)
+			query := parsed.Query()
+			query.Set("streamid", target.StreamKey)
+			parsed.RawQuery = query.Encode()
+			uri = parsed.String()
+		}
+
+		return fmt.Sprintf(`mpegtsmux name=mux ! srtsink uri="%s"`, uri)
+	}
+
+	location := strings.TrimSuffix(target.URL, "/")
+	if target.StreamKey != "" {
+		location += "/" + target.StreamKey
+	}
+
+	return fmt.Sprintf(
+		`flvmux name=mux streamable=true ! rtmp2sink location="%s"`, location,
+	)
+}
+
+// must be called with mutex locked.
+// taps the primary encode if it's h264 that every service can take
+func updatePushVideo() {
+	video := "gst-video"
+	if getStreamSettings().getCodec() != codecH264 {
+		video = "gst-video-fallback"
+	}
+
+	if video == pushVideo {
+		return
+	}
+
+	if pushVideo != "" {
+		untapRTP(strings.TrimPrefix(pushVideo, "gst-"), "push-video")
+		releasePipeline(pushVideo)
+	}
+
+	tapRTP(strings.TrimPrefix(video, "gst-"), "push-video")
+	acquirePipeline(video)
+
+	pushVideo = video
+}
+
+func getPushPipeline() []string {
+	pushMutex.Lock()
+	defer pushMutex.Unlock()
+
+	if push == nil {
+		return []string{"fakesrc", "fakesink"}
+	}
+
+	// the codec might have changed since the last start
+	updatePushVideo()
+
+	requestKeyframeSoon(pushVideo)
+
+	audio := strings.Join([]string{
+		rtpSource("push-audio",
+			"application/x-rtp,media=audio,clock-rate=48000,encoding-name=OPUS",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtpopusdepay",
+		"opusdec",
+		"audioconvert",
+		"audioresample",
+		fmt.Sprintf(
+			"avenc_aac bitrate=%d", getStreamSettings().AudioBitrate,
+		),
+		"aacparse",
+		"queue",
+		"mux.",
+	}, " ! ")
+
+	return []string{
+		rtpSource("push-video",
+			"application/x-rtp,media=video,clock-rate=90000,encoding-name=H264",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtph264depay",
+		"h264parse config-interval=-1",
+		"queue",
+		"mux. " + audio + " " + push.getSink(),
+	}
+}
+
+func startPush(target pushTarget) {
+	pushMutex.Lock()
+	defer pushMutex.Unlock()
+
+	push = &target
+
+	if processes.Has("gst-push") {
+		processes.Restart("gst-push")
+		return
+	}
+
+	tapRTP("audio", "push-audio")
+	acquirePipeline("gst-audio")
+	updatePushVideo()
+	acquirePointer()
+
+	addPipeline(pipeline{
+		ID:          "gst-push",
+		GetElements: getPushPipeline,
+	})
+}
+
+func stopPush() {
+	pushMutex.Lock()
+	defer pushMutex.Unlock()
+
+	if push == nil {
+		return
+	}
+
+	push = nil
+
+	processes.Remove("gst-push")
+
+	untapRTP("audio", "push-audio")
+	releasePipeline("gst-audio")
+
+	untapRTP(strings.TrimPrefix(pushVideo, "gst-"), "push-video")
+	releasePipeline(pushVideo)
+	pushVideo = ""
+
+	releasePointer()
+}
+
+func getPushStatus() pushStatus {
+	pushMutex.Lock()
+	defer pushMutex.Unlock()
+
+	if push == nil {
+		return pushStatus{}
+	}
+
+	status := pushStatus{
+		Active: true,
+		// stream key isnt shown
+		URL: push.URL,
+	}
+
+	for _, process := range processes.Status() {
+		if process.ID == "gst-push" {
+			status.Running = process.Running
+			status.Failures = process.Failures
+			status.LastError = process.LastError
+		}
+	}
+
+	return status
+}
+
+func writePushStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getPushStatus())
+}
+
+func getPushHandler(w http.ResponseWriter, r *http.Request) {
+	writePushStatus(w)
+}
+
+func postPushHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	var target pushTarget
+	err = json.Unmarshal(body, &target)
+	if err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = target.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	slog.Info("starting push", "url", target.URL)
+	startPush(target)
+
+	writePushStatus(w)
+}
+
+func deletePushHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("stopping push")
+	stopPush()
+
+	writePushStatus(w)
+}
+
+func initPush(httpMux *http.ServeMux) {
+	httpMux.HandleFunc("GET /api/admin/push", adminOnly(getPushHandler))
+	httpMux.HandleFunc("POST /api/admin/push", adminOnly(postPushHandler))
+	httpMux.HandleFunc("DELETE /api/admin/push", adminOnly(deletePushHandler))
+}
@@ -0,0 +1,90 @@
+package src
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getPushVideo() string {
+	pushMutex.Lock()
+	defer pushMutex.Unlock()
+	return pushVideo
+}
+
+func getPushRestarts() int {
+	for _, process := range processes.Status() {
+		if process.ID == "gst-push" {
+			return process.Restarts
+		}
+	}
+	return 0
+}
+
+func TestPushToSRTListener(t *testing.T) {
+	startTestPipelines(t)
+
+	port := getFreeLocalPort(t)
+	received := filepath.Join(t.TempDir(), "push.ts")
+
+	// keeps listening so the push can reconnect after restarting
+	startGStreamer(t, fmt.Sprintf(
+		`srtsrc uri="srt://127.0.0.1:%d?mode=listener" keep-listening=true `+
+			`! filesink location="%s"`,
+		port, received,
+	))
+
+	startPush(pushTarget{URL: fmt.Sprintf("srt://127.0.0.1:%d", port)})
+	t.Cleanup(stopPush)
+
+	if getPushVideo() != "gst-video" {
+		t.Fatalf("expected the h264 encode, got %s", getPushVideo())
+	}
+
+	size := waitForFileSize(t, received, 0)
+
+	// mpeg-ts cant take vp9, so the fallback has to be pushed
+	old := getStreamSettings()
+	applyStreamSettings(old, old.withProfile("text"))
+	t.Cleanup(func() {
+		applyStreamSettings(getStreamSettings(), old)
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for getPushRestarts() == 0 || getPushVideo() != "gst-video-fallback" {
+		if time.Now().After(deadline) {
+			t.Fatalf("push wasnt restarted, tapping %s", getPushVideo())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	waitForFileSize(t, received, size)
+}
+
+func TestPushRejectsUnsafeTargets(t *testing.T) {
+	targets := []pushTarget{
+		{URL: `rtmp://example.com/live" ! filesink location="/tmp/x`},
+		{URL: "rtmp://example.com/$(touch /tmp/x)"},
+		{URL: "rtmp://example.com/`touch /tmp/x`"},
+		{URL: "srt://example.com:9000 ! fakesink"},
+		{URL: "rtmp://example.com/live'"},
+		{URL: "rtmp://example.com/live\n"},
+		{URL: "rtmp://example.com/live", StreamKey: "key\"!"},
+		{URL: "rtmp://example.com/live", StreamKey: "key\x00"},
+		{URL: "rtmp://example.com/live", StreamKey: "a key"},
+	}
+
+	for _, target := range targets {
+		if target.validate() == nil {
+			t.Errorf("allowed %q with key %q", target.URL, target.StreamKey)
+		}
+	}
+
+	target := pushTarget{
+		URL: "srt://example.com:9000?latency=200", StreamKey: "live/abc-123",
+	}
+	if err := target.validate(); err != nil {
+		t.Errorf("refused a normal target: %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/inuws"
+)
+
+// records the same rtp sent to viewers, so there's no extra encode
+
+type recordingFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type recordingsResponse struct {
+	// empty if not recording
+	Current string          `json:"current"`
+	Files   []recordingFile `json:"files"`
+}
+
+var (
+	recording      bool
+	recordingName  string
+	recordingMutex sync.Mutex
+
+	// held while starting or stopping, which cant overlap
+	recordingControlMutex sync.Mutex
+)
+
+func getRecordingsDir() string {
+	return filepath.Join(config.DATA_DIR, "recordings")
+}
+
+func getRecordingMuxer() string {
+	if config.RECORDING_FORMAT == "mp4" {
+		// fragmented so it's still playable if we're killed
+		return "mp4mux name=mux fragment-duration=1000"
+	}
+	return "matroskamux name=mux"
+}
+
+// restarted when the codec changes, which can be within the same second
+func getNewRecordingName() string {
+	base := time.Now().Format("2006-01-02_15-04-05")
+
+	name := base + "." + config.RECORDING_FORMAT
+	for i := 2; ; i++ {
+		_, err := os.Stat(filepath.Join(getRecordingsDir(), name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d.%s", base, i, config.RECORDING_FORMAT)
+	}
+}
+
+func getRecordingPipeline() []string {
+	recordingMutex.Lock()
+	defer recordingMutex.Unlock()
+
+	// new file every start, since the codec cant change mid file
+	recordingName = getNewRecordingName()
+
+	requestKeyframeSoon("gst-video")
+
+	video := []string{
+		rtpSource("record-video",
+			"application/x-rtp,media=video,clock-rate=90000,encoding-name=H264",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtph264depay",
+		"h264parse",
+	}
+
+	if getStreamSettings().getCodec() == codecVP9444 {
+		video = []string{
+			rtpSource("record-video",
+				"application/x-rtp,media=video,clock-rate=90000,encoding-name=VP9",
+			),
+			"rtpjitterbuffer latency=100",
+			"rtpvp9depay",
+		}
+	}
+
+	audio := strings.Join([]string{
+		rtpSource("record-audio",
+			"application/x-rtp,media=audio,clock-rate=48000,encoding-name=OPUS",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtpopusdepay",
+		"opusparse",
+		"queue",
+		"mux.",
+	}, " ! ")
+
+	return append(video,
+		"queue",
+		"mux. "+audio+" "+getRecordingMuxer(),
+		fmt.Sprintf(
+			`filesink location="%s"`,
+			filepath.Join(getRecordingsDir(), recordingName),
+		),
+	)
+}
+
+func startRecording() error {
+	recordingControlMutex.Lock()
+	defer recordingControlMutex.Unlock()
+
+	recordingMutex.Lock()
+	defer recordingMutex.Unlock()
+
+	if recording {
+		return nil
+	}
+
+	err := os.MkdirAll(getRecordingsDir(), 0755)
+	if err != nil {
+		return err
+	}
+
+	recording = true
+
+	tapRTP("video", "record-video")
+	tapRTP("audio", "record-audio")
+	acquirePipeline("gst-video")
+	acquirePipeline("gst-audio")
+	acquirePointer()
+
+	addPipeline(pipeline{
+		ID:          "gst-record",
+		GetElements: getRecordingPipeline,
+		EOSOnStop:   true,
+	})
+
+	slog.Info("recording started")
+
+	return nil
+}
+
+// waits for the file to be finished
+func stopRecording() {
+	recordingControlMutex.Lock()
+	defer recordingControlMutex.Unlock()
+
+	recordingMutex.Lock()
+	if !recording {
+		recordingMutex.Unlock()
+		return
+	}
+	recording = false
+	recordingMutex.Unlock()
+
+	// pipeline needs the mutex to start, so cant hold it here
+	err := processes.RemoveAndWait("gst-record", eosTimeout+time.Second)
+	if err != nil {
+		slog.Warn("failed to stop recording", "err", err.Error())
+	}
+
+	recordingMutex.Lock()
+	defer recordingMutex.Unlock()
+
+	untapRTP("video", "record-video")
+	untapRTP("audio", "record-audio")
+	releasePipeline("gst-video")
+	releasePipeline("gst-audio")
+	releasePointer()
+
+	slog.Info("recording stopped", "name", recordingName)
+	recordingName = ""
+}
+
+func getRecordings() ([]recordingFile, error) {
+	entries, err := os.ReadDir(getRecordingsDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return []recordingFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := []recordingFile{}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		files = append(files, recordingFile{
+			Name:     entry.Name(),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+	}
+
+	// newest first
+	slices.Reverse(files)
+
+	return files, nil
+}
+
+// returns empty if the name could escape the directory
+func getRecordingPath(name string) string {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return filepath.Join(getRecordingsDir(), name)
+}
+
+func writeRecordingsResponse(w http.ResponseWriter) {
+	files, err := getRecordings()
+	if err != nil {
+		http.Error(w, "failed to list recordings", http.StatusInternalServerError)
+		return
+	}
+
+	recordingMutex.Lock()
+	current := recordingName
+	recordingMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordingsResponse{
+		Current: current,
+		Files:   files,
+	})
+}
+
+func getRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	writeRecordingsResponse(w)
+}
+
+func postRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		// start or stop
+		Action string `json:"action"`
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch request.Action {
+	case "start":
+		err = startRecording()
+		if err != nil {
+			slog.Error("failed to start recording", "err", err.Error())
+			http.Error(w, "failed to start recording",
+				http.StatusInternalServerError)
+			return
+		}
+
+	case "stop":
+		stopRecording()
+
+	default:
+		http.Error(w, "action must be start or stop",
+			http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeRecordingsResponse(w)
+}
+
+func downloadRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	path := getRecordingPath(r.PathValue("name"))
+	if path == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(path)),
+	)
+
+	http.ServeFile(w, r, path)
+}
+
+func deleteRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	path := getRecordingPath(name)
+	if path == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	recordingMutex.Lock()
+	current := recordingName
+	recordingMutex.Unlock()
+
+	if name == current {
+		http.Error(w, "still recording", http.StatusConflict)
+		return
+	}
+
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to delete recording",
+			http.StatusInternalServerError)
+		return
+	}
+
+	writeRecordingsResponse(w)
+}
+
+func initRecordings(httpMux *http.ServeMux) {
+	if config.RECORDING_FORMAT != "mkv" && config.RECORDING_FORMAT != "mp4" {
+		panic("RECORDING_FORMAT must be mkv or mp4")
+	}
+
+	httpMux.HandleFunc("GET /api/admin/recordings",
+		adminOnly(getRecordingsHandler))
+	httpMux.HandleFunc("POST /api/admin/recordings",
+		adminOnly(postRecordingsHandler))
+	httpMux.HandleFunc("GET /api/admin/recordings/{name}",
+		adminOnly(downloadRecordingHandler))
+	httpMux.HandleFunc("DELETE /api/admin/recordings/{name}",
+		adminOnly(deleteRecordingHandler))
+
+	if !config.AUTO_RECORD {
+		return
+	}
+
+	inuws.ControllerSignal.AddListener(
+		func(ctx context.Context, session string) {
+			if session == "" {
+				stopRecording()
+				return
+			}
+
+			err := startRecording()
+			if err != nil {
+				slog.Error("failed to start recording", "err", err.Error())
+			}
+		},
+	)
+}
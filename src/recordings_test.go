@@ -0,0 +1,51 @@
+package src
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getRecordingName() string {
+	recordingMutex.Lock()
+	defer recordingMutex.Unlock()
+	return recordingName
+}
+
+func TestRecordingRestartsOnCodecChange(t *testing.T) {
+	startTestPipelines(t)
+
+	err := startRecording()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stopRecording)
+
+	first := getRecordingName()
+	waitForFileSize(t, filepath.Join(getRecordingsDir(), first), 0)
+
+	// vp9 cant be appended to an h264 file
+	old := getStreamSettings()
+	applyStreamSettings(old, old.withProfile("text"))
+	t.Cleanup(func() {
+		applyStreamSettings(getStreamSettings(), old)
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for getRecordingName() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("recording wasnt restarted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	waitForFileSize(t, filepath.Join(getRecordingsDir(), getRecordingName()), 0)
+
+	files, err := getRecordings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Errorf("expected a file per codec, got %d", len(files))
+	}
+}
@@ -0,0 +1,480 @@
+package src
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+)
+
+// keeps the last few minutes of what viewers saw in memory as mpeg-ts,
+// cut where keyframes start so clips can be decoded from the beginning,
+// then remuxes it to mp4 when saved.
+// only buffers whilst the desktop is being encoded
+
+const tsPacketSize = 188
+
+type replayChunk struct {
+	time time.Time
+	data []byte
+	// starts with the packet a keyframe starts in
+	keyframe bool
+}
+
+// finds keyframes from the random access flag mpegtsmux sets on them,
+// which needs the tables to know which stream is video
+type tsScanner struct {
+	pmtPID   int
+	videoPID int
+	// latest of each, put before clips in case they start without them
+	pat []byte
+	pmt []byte
+}
+
+type replayStatus struct {
+	// seconds
+	Buffered    float64 `json:"buffered"`
+	MaxDuration float64 `json:"maxDuration"`
+	Size        int     `json:"size"`
+	MaxSize     int     `json:"maxSize"`
+}
+
+var (
+	replayChunks  []replayChunk
+	replaySize    int
+	replayScanner tsScanner
+	replayMutex   sync.Mutex
+
+	// which video stream is being tapped
+	replayVideo string
+
+	errReplayEmpty = errors.New("nothing buffered")
+
+	// signs clip names, so the link works for whoever saved it after
+	// control moves on
+	clipSecret []byte
+)
+
+func newTSScanner() tsScanner {
+	return tsScanner{pmtPID: -1, videoPID: -1}
+}
+
+// payload of a table section, after the pointer field
+func getTSSection(packet []byte, payload int) []byte {
+	if payload >= len(packet) {
+		return nil
+	}
+	start := payload + 1 + int(packet[payload])
+	if start+3 > len(packet) {
+		return nil
+	}
+	section := packet[start:]
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+length > len(section) {
+		return nil
+	}
+	// without the crc
+	return section[:max(3+length-4, 0)]
+}
+
+func (scanner *tsScanner) readPAT(section []byte) {
+	// first program that isnt the network pid
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			scanner.pmtPID = int(section[i+2]&0x1f)<<8 | int(section[i+3])
+			return
+		}
+	}
+}
+
+func (scanner *tsScanner) readPMT(section []byte) {
+	if len(section) < 12 {
+		return
+	}
+
+	i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	for i+5 <= len(section) {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1f)<<8 | int(section[i+2])
+		// h264
+		if streamType == 0x1b {
+			scanner.videoPID = pid
+			return
+		}
+		i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+	}
+}
+
+// returns the offset of the packet a keyframe starts in, or -1
+func (scanner *tsScanner) scan(data []byte) int {
+	keyframe := -1
+
+	for offset := 0; offset+tsPacketSize <= len(data); offset += tsPacketSize {
+		packet := data[offset : offset+tsPacketSize]
+		if packet[0] != 0x47 {
+			continue
+		}
+
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		unitStart := packet[1]&0x40 != 0
+		hasAdaptation := packet[3]&0x20 != 0
+
+		payload := 4
+		if hasAdaptation {
+			payload += 1 + int(packet[4])
+		}
+
+		switch {
+		case pid == 0 && unitStart:
+			scanner.readPAT(getTSSection(packet, payload))
+			scanner.pat = slices.Clone(packet)
+
+		case pid == scanner.pmtPID && unitStart:
+			scanner.readPMT(getTSSection(packet, payload))
+			scanner.pmt = slices.Clone(packet)
+
+		case pid == scanner.videoPID && hasAdaptation && packet[4] > 0 &&
+			packet[5]&0x40 != 0 && keyframe < 0:
+			keyframe = offset
+		}
+	}
+
+	return keyframe
+}
+
+// must be called with mutex locked
+func appendReplayChunk(chunk replayChunk) {
+	// nothing can be decoded until the first keyframe
+	if len(replayChunks) == 0 && !chunk.keyframe {
+		return
+	}
+	replayChunks = append(replayChunks, chunk)
+	replaySize += len(chunk.data)
+}
+
+// must be called with mutex locked
+func resetReplay() {
+	replayChunks = nil
+	replaySize = 0
+	replayScanner = newTSScanner()
+}
+
+func writeReplay(data []byte) {
+	now := time.Now()
+	data = slices.Clone(data)
+
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+
+	// split so chunks start where keyframes do
+	keyframe := replayScanner.scan(data)
+	if keyframe > 0 {
+		appendReplayChunk(replayChunk{time: now, data: data[:keyframe]})
+	}
+	appendReplayChunk(replayChunk{
+		time: now, data: data[max(keyframe, 0):], keyframe: keyframe >= 0,
+	})
+
+	maxSize := config.REPLAY_BUFFER_SIZE * 1024 * 1024
+
+	i := 0
+	for i < len(replayChunks) && (replaySize > maxSize ||
+		now.Sub(replayChunks[i].time) > config.REPLAY_DURATION) {
+		replaySize -= len(replayChunks[i].data)
+		i++
+	}
+
+	// clips have to start on a keyframe
+	if i > 0 {
+		for i < len(replayChunks) && !replayChunks[i].keyframe {
+			replaySize -= len(replayChunks[i].data)
+			i++
+		}
+	}
+
+	// so the data can be freed
+	clear(replayChunks[:i])
+	replayChunks = replayChunks[i:]
+}
+
+func getReplayStatus() replayStatus {
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+
+	status := replayStatus{
+		MaxDuration: config.REPLAY_DURATION.Seconds(),
+		Size:        replaySize,
+		MaxSize:     config.REPLAY_BUFFER_SIZE * 1024 * 1024,
+	}
+
+	if len(replayChunks) > 0 {
+		status.Buffered = replayChunks[len(replayChunks)-1].time.Sub(
+			replayChunks[0].time,
+		).Seconds()
+	}
+
+	return status
+}
+
+func getReplayPipeline() []string {
+	// timestamps start again with the pipeline, so cant be joined
+	replayMutex.Lock()
+	resetReplay()
+	replayMutex.Unlock()
+
+	// mpeg-ts players are only expected to take h264
+	video := getH264VideoStream()
+
+	if video != replayVideo {
+		if replayVideo != "" {
+			untapRTP(replayVideo, "replay-video")
+		}
+		tapRTP(video, "replay-video")
+		replayVideo = video
+	}
+
+	audio := strings.Join([]string{
+		rtpSource("replay-audio",
+			"application/x-rtp,media=audio,clock-rate=48000,encoding-name=OPUS",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtpopusdepay",
+		"opusparse",
+		"queue",
+		"mux.",
+	}, " ! ")
+
+	return []string{
+		rtpSource("replay-video",
+			"application/x-rtp,media=video,clock-rate=90000,encoding-name=H264",
+		),
+		"rtpjitterbuffer latency=100",
+		"rtph264depay",
+		// so there's always headers before the keyframe
+		"h264parse config-interval=-1",
+		"queue",
+		"mux. " + audio + " mpegtsmux name=mux alignment=7",
+		rtpSink("replay", writeReplay),
+	}
+}
+
+func getClipsDir() string {
+	return filepath.Join(config.DATA_DIR, "clips")
+}
+
+// creates the file so saves in the same second dont take the same name
+func createNewClip() (string, error) {
+	base := "clip_" + time.Now().Format("2006-01-02_15-04-05")
+
+	name := base + ".mp4"
+	for i := 2; ; i++ {
+		file, err := os.OpenFile(
+			filepath.Join(getClipsDir(), name), os.O_CREATE|os.O_EXCL, 0644,
+		)
+		if err == nil {
+			file.Close()
+			return name, nil
+		} else if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		name = fmt.Sprintf("%s_%d.mp4", base, i)
+	}
+}
+
+// returns the file name
+func saveClip(ctx context.Context) (string, error) {
+	replayMutex.Lock()
+	chunks := slices.Clone(replayChunks)
+	header := slices.Concat(replayScanner.pat, replayScanner.pmt)
+	replayMutex.Unlock()
+
+	if len(chunks) == 0 {
+		return "", errReplayEmpty
+	}
+
+	ts, err := os.CreateTemp("", "inu-replay-*.ts")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(ts.Name())
+
+	_, err = ts.Write(header)
+	if err != nil {
+		ts.Close()
+		return "", err
+	}
+
+	for _, chunk := range chunks {
+		_, err = ts.Write(chunk.data)
+		if err != nil {
+			ts.Close()
+			return "", err
+		}
+	}
+
+	err = ts.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(getClipsDir(), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := createNewClip()
+	if err != nil {
+		return "", err
+	}
+
+	err = runPipelineOnce(ctx, "gst-clip", []string{
+		fmt.Sprintf(`filesrc location="%s"`, ts.Name()),
+		"tsdemux name=demux demux.",
+		"video/x-h264",
+		"queue",
+		"h264parse",
+		"mux. demux.",
+		"audio/x-opus",
+		"queue",
+		"opusparse",
+		"mux. mp4mux name=mux",
+		fmt.Sprintf(
+			`filesink location="%s"`, filepath.Join(getClipsDir(), name),
+		),
+	})
+	if err != nil {
+		os.Remove(filepath.Join(getClipsDir(), name))
+		return "", err
+	}
+
+	return name, nil
+}
+
+func getClipToken(name string) string {
+	mac := hmac.New(sha256.New, clipSecret)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func canDownloadClip(r *http.Request, name string) bool {
+	if isAdmin(r) {
+		return true
+	}
+
+	return hmac.Equal(
+		[]byte(r.URL.Query().Get("token")), []byte(getClipToken(name)),
+	)
+}
+
+func canSaveClip(r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+
+	switch config.REPLAY_SAVE {
+	case "anyone":
+		return true
+
+	case "controller":
+		return isController(r)
+	}
+
+	return false
+}
+
+func replayStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getReplayStatus())
+}
+
+func saveClipHandler(w http.ResponseWriter, r *http.Request) {
+	if !canSaveClip(r) {
+		http.Error(w, "not allowed to save clips", http.StatusForbidden)
+		return
+	}
+
+	name, err := saveClip(r.Context())
+	if errors.Is(err, errReplayEmpty) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.Error("failed to save clip", "err", err.Error())
+		http.Error(w, "failed to save clip", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("clip saved", "name", name)
+
+	url := "/api/replay/clips/" + name + "?token=" + getClipToken(name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"name": name,
+		"url":  url,
+	})
+}
+
+func downloadClipHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	if !canDownloadClip(r, name) {
+		http.Error(w, "not allowed to download clips", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set(
+		"Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name),
+	)
+
+	http.ServeFile(w, r, filepath.Join(getClipsDir(), name))
+}
+
+func initReplay(httpMux *http.ServeMux) {
+	if !config.REPLAY {
+		return
+	}
+
+	switch config.REPLAY_SAVE {
+	case "controller", "anyone", "admin":
+	default:
+		panic("REPLAY_SAVE must be controller, anyone or admin")
+	}
+
+	clipSecret = make([]byte, 32)
+	rand.Read(clipSecret)
+
+	replayScanner = newTSScanner()
+
+	tapRTP("audio", "replay-audio")
+
+	addPipeline(pipeline{
+		ID:          "gst-replay",
+		GetElements: getReplayPipeline,
+	})
+
+	httpMux.HandleFunc("GET /api/replay", replayStatusHandler)
+	httpMux.HandleFunc("POST /api/replay/clips", saveClipHandler)
+	httpMux.HandleFunc("GET /api/replay/clips/{name}", downloadClipHandler)
+}
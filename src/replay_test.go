@@ -0,0 +1,198 @@
+package src
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+)
+
+const testVideoPID = 0x41
+
+func newTestTSPacket(pid int, unitStart bool, adaptationFlags byte) []byte {
+	packet := bytes.Repeat([]byte{0xff}, tsPacketSize)
+	packet[0] = 0x47
+	packet[1] = byte(pid>>8) & 0x1f
+	if unitStart {
+		packet[1] |= 0x40
+	}
+	packet[2] = byte(pid)
+	// payload only
+	packet[3] = 0x10
+	if adaptationFlags != 0 {
+		packet[3] = 0x30
+		packet[4] = 1
+		packet[5] = adaptationFlags
+	}
+	return packet
+}
+
+// pointer field, then the section with a fake crc
+func newTestTSTable(pid int, section []byte) []byte {
+	packet := newTestTSPacket(pid, true, 0)
+	copy(packet[4:], append([]byte{0}, section...))
+	return packet
+}
+
+func newTestPAT() []byte {
+	return newTestTSTable(0, []byte{
+		0x00, 0xb0, 13, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		// program 1 at pid 0x20
+		0x00, 0x01, 0xe0, 0x20,
+		0, 0, 0, 0,
+	})
+}
+
+func newTestPMT() []byte {
+	return newTestTSTable(0x20, []byte{
+		0x02, 0xb0, 23, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe0, testVideoPID, 0xf0, 0x00,
+		// opus in private data, then h264
+		0x06, 0xe0, 0x42, 0xf0, 0x00,
+		0x1b, 0xe0, testVideoPID, 0xf0, 0x00,
+		0, 0, 0, 0,
+	})
+}
+
+func newTestKeyframe() []byte {
+	return newTestTSPacket(testVideoPID, true, 0x40)
+}
+
+func newTestFrame() []byte {
+	return newTestTSPacket(testVideoPID, true, 0)
+}
+
+func getReplayChunks() []replayChunk {
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+	return replayChunks
+}
+
+func TestReplayStartsOnKeyframes(t *testing.T) {
+	defaultDuration := config.REPLAY_DURATION
+	t.Cleanup(func() {
+		config.REPLAY_DURATION = defaultDuration
+		replayMutex.Lock()
+		resetReplay()
+		replayMutex.Unlock()
+	})
+	config.REPLAY_DURATION = 100 * time.Millisecond
+
+	replayMutex.Lock()
+	resetReplay()
+	replayMutex.Unlock()
+
+	// nothing to decode from yet
+	writeReplay(bytes.Join([][]byte{
+		newTestPAT(), newTestPMT(), newTestFrame(),
+	}, nil))
+
+	if len(getReplayChunks()) != 0 {
+		t.Fatal("buffered before a keyframe")
+	}
+
+	// the frame before the keyframe is cut off
+	writeReplay(bytes.Join([][]byte{
+		newTestFrame(), newTestKeyframe(), newTestFrame(),
+	}, nil))
+
+	chunks := getReplayChunks()
+	if len(chunks) != 1 || !chunks[0].keyframe ||
+		!bytes.Equal(chunks[0].data[:tsPacketSize], newTestKeyframe()) {
+		t.Fatal("buffer doesnt start on the keyframe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	writeReplay(newTestFrame())
+	writeReplay(newTestKeyframe())
+
+	time.Sleep(60 * time.Millisecond)
+
+	// the first keyframe is too old, so the frame after it goes too
+	writeReplay(newTestFrame())
+
+	chunks = getReplayChunks()
+	if len(chunks) != 2 || !chunks[0].keyframe || chunks[1].keyframe {
+		t.Fatalf("expected the second keyframe and a frame, got %d chunks",
+			len(chunks))
+	}
+
+	replayMutex.Lock()
+	size := replaySize
+	header := bytes.Join([][]byte{replayScanner.pat, replayScanner.pmt}, nil)
+	replayMutex.Unlock()
+
+	if size != 2*tsPacketSize {
+		t.Errorf("expected size %d, got %d", 2*tsPacketSize, size)
+	}
+
+	if !bytes.Equal(header, bytes.Join([][]byte{newTestPAT(), newTestPMT()}, nil)) {
+		t.Error("tables werent kept for the clip")
+	}
+}
+
+func TestClipNamesDontCollide(t *testing.T) {
+	defaultDataDir := config.DATA_DIR
+	t.Cleanup(func() { config.DATA_DIR = defaultDataDir })
+	config.DATA_DIR = t.TempDir()
+
+	err := os.MkdirAll(getClipsDir(), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for range 3 {
+		name, err := createNewClip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names[name] {
+			t.Fatalf("%s was taken twice", name)
+		}
+		names[name] = true
+	}
+}
+
+func TestClipDownloadNeedsToken(t *testing.T) {
+	defaultDataDir, defaultSecret := config.DATA_DIR, clipSecret
+	t.Cleanup(func() { config.DATA_DIR, clipSecret = defaultDataDir, defaultSecret })
+	config.DATA_DIR = t.TempDir()
+	clipSecret = []byte("secret")
+
+	err := os.MkdirAll(getClipsDir(), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := createNewClip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpMux := http.NewServeMux()
+	httpMux.HandleFunc("GET /api/replay/clips/{name}", downloadClipHandler)
+
+	tests := map[string]int{
+		// whoever saved it, even without control anymore
+		"?token=" + getClipToken(name):          http.StatusOK,
+		"":                                      http.StatusForbidden,
+		"?token=wrong":                          http.StatusForbidden,
+		"?token=" + getClipToken(name+"_other"): http.StatusForbidden,
+	}
+
+	for query, status := range tests {
+		recorder := httptest.NewRecorder()
+		httpMux.ServeHTTP(recorder, httptest.NewRequest(
+			"GET", "/api/replay/clips/"+name+query, nil,
+		))
+		if recorder.Code != status {
+			t.Errorf("%q: expected %d, got %d", query, status, recorder.Code)
+		}
+	}
+}
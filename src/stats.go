@@ -0,0 +1,59 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/inuwebrtc"
+	"github.com/makinori/inu-desktop/src/inuws"
+	"github.com/makinori/inu-desktop/src/supervisor"
+)
+
+// every peer for admins, and viewers get their own over the websocket
+
+const peerStatsInterval = time.Second * 2
+
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inuwebrtc.GetPeerStats())
+}
+
+func sendPeerStats(ctx context.Context) error {
+	ticker := time.NewTicker(peerStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		sessions := map[string][]inuwebrtc.PeerStats{}
+		for _, peer := range inuwebrtc.GetPeerStats() {
+			if peer.Session == "" {
+				continue
+			}
+			sessions[peer.Session] = append(sessions[peer.Session], peer)
+		}
+
+		for session, peers := range sessions {
+			data, err := json.Marshal(peers)
+			if err != nil {
+				continue
+			}
+			inuws.SendPeerStats(session, data)
+		}
+	}
+}
+
+func initStats(httpMux *http.ServeMux) {
+	httpMux.HandleFunc("GET /api/admin/peers", adminOnly(peersHandler))
+
+	processes.AddFunc(supervisor.Func{
+		ID:  "peer-stats",
+		Run: sendPeerStats,
+	})
+}
@@ -0,0 +1,306 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/makinori/inu-desktop/src/config"
+)
+
+// encoder settings which admins can change whilst running
+type streamSettings struct {
+	// see getQualityProfile
+	Profile string `json:"profile"`
+	// kbit/s
+	VideoBitrate int    `json:"videoBitrate"`
+	RateControl  string `json:"rateControl"`
+	Preset       string `json:"preset"`
+	// frames between keyframes
+	GOP       int `json:"gop"`
+	Framerate int `json:"framerate"`
+	// bit/s
+	AudioBitrate int `json:"audioBitrate"`
+}
+
+var (
+	currentStreamSettings      streamSettings
+	currentStreamSettingsMutex sync.RWMutex
+
+	// so two puts dont apply at once
+	applyStreamMutex sync.Mutex
+)
+
+func getStreamSettings() streamSettings {
+	currentStreamSettingsMutex.RLock()
+	defer currentStreamSettingsMutex.RUnlock()
+	return currentStreamSettings
+}
+
+func getDefaultStreamSettings() streamSettings {
+	settings := streamSettings{
+		VideoBitrate: 6000,
+		Framerate:    config.FRAMERATE,
+		AudioBitrate: 320000,
+	}
+
+	return settings.withProfile(config.QUALITY_PROFILE)
+}
+
+// resets rate control, preset and gop to the profile's
+func (settings streamSettings) withProfile(name string) streamSettings {
+	settings.Profile = name
+
+	profile, ok := getQualityProfile(name)
+	if !ok {
+		return settings
+	}
+
+	settings.RateControl = profile.RateControl
+	settings.Preset = profile.Preset
+	settings.GOP = profile.GOPSeconds * settings.Framerate
+
+	return settings
+}
+
+func (settings streamSettings) validate() error {
+	profiles := getQualityProfileNames()
+	if !slices.Contains(profiles, settings.Profile) {
+		return fmt.Errorf("profile must be one of %v", profiles)
+	}
+
+	options := getEncoderOptions(settings.getCodec())
+
+	if settings.VideoBitrate < 100 || settings.VideoBitrate > 100000 {
+		return errors.New("videoBitrate must be between 100 and 100000 kbit/s")
+	}
+
+	if !slices.Contains(options.RateControls, settings.RateControl) {
+		return fmt.Errorf(
+			"rateControl for %s must be one of %v",
+			options.Encoder, options.RateControls,
+		)
+	}
+
+	if !slices.Contains(options.Presets, settings.Preset) {
+		return fmt.Errorf(
+			"preset for %s must be one of %v", options.Encoder, options.Presets,
+		)
+	}
+
+	if settings.GOP < 1 || settings.GOP > 1000 {
+		return errors.New("gop must be between 1 and 1000 frames")
+	}
+
+	if settings.Framerate < 1 || settings.Framerate > 240 {
+		return errors.New("framerate must be between 1 and 240")
+	}
+
+	// https://gstreamer.freedesktop.org/documentation/opus/opusenc.html
+	if settings.AudioBitrate < 4000 || settings.AudioBitrate > 650000 {
+		return errors.New("audioBitrate must be between 4000 and 650000 bit/s")
+	}
+
+	return nil
+}
+
+func getStreamSettingsPath() string {
+	return filepath.Join(config.DATA_DIR, "stream.json")
+}
+
+func loadStreamSettings() streamSettings {
+	settings := getDefaultStreamSettings()
+
+	data, err := os.ReadFile(getStreamSettingsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return settings
+	}
+	if err != nil {
+		slog.Error("failed to read stream settings", "err", err.Error())
+		return settings
+	}
+
+	err = json.Unmarshal(data, &settings)
+	if err == nil {
+		err = settings.validate()
+	}
+	if err != nil {
+		// might have been saved with another encoder
+		slog.Warn("ignoring saved stream settings", "err", err.Error())
+		return getDefaultStreamSettings()
+	}
+
+	slog.Info("loaded stream settings", "path", getStreamSettingsPath())
+
+	return settings
+}
+
+func saveStreamSettings(settings streamSettings) error {
+	err := os.MkdirAll(config.DATA_DIR, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(settings, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// rename so a crash cant leave half a file
+	path := getStreamSettingsPath()
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func applyStreamSettings(old streamSettings, updated streamSettings) {
+	currentStreamSettingsMutex.Lock()
+	currentStreamSettings = updated
+	currentStreamSettingsMutex.Unlock()
+
+	if updated.AudioBitrate != old.AudioBitrate {
+		updatePipeline("gst-audio", "encoder", "bitrate", updated.AudioBitrate)
+	}
+
+	if updated.Profile != old.Profile {
+		setWebRTCCodec(updated.getCodec())
+	}
+
+	// they pick which encode to tap when started.
+	// errors if not running which is fine
+	if updated.getCodec() != old.getCodec() {
+		for _, id := range []string{
+			"gst-push", "gst-record", "gst-replay", "gst-hls",
+		} {
+			processes.Restart(id)
+		}
+
+		// replay might need the fallback encode now
+		updateControlledPipelines()
+	}
+
+	// caps and most encoder properties cant change whilst playing.
+	// errors if not running which is fine
+	if updated.Profile != old.Profile || updated.RateControl != old.RateControl ||
+		updated.Preset != old.Preset || updated.GOP != old.GOP ||
+		updated.Framerate != old.Framerate {
+		if updated.Framerate != old.Framerate {
+			framerate.Store(int32(updated.Framerate))
+		}
+		processes.Restart("gst-video")
+		processes.Restart("gst-video-fallback")
+		return
+	}
+
+	if updated.VideoBitrate != old.VideoBitrate {
+		options := getEncoderOptions(updated.getCodec())
+		updatePipeline(
+			"gst-video", "encoder", options.bitrateProperty,
+			updated.VideoBitrate*options.bitrateScale,
+		)
+
+		fallback := getEncoderOptions(updated.getFallback().getCodec())
+		updatePipeline(
+			"gst-video-fallback", "encoder", fallback.bitrateProperty,
+			updated.VideoBitrate*fallback.bitrateScale,
+		)
+	}
+}
+
+type streamResponse struct {
+	Settings streamSettings `json:"settings"`
+	Options  encoderOptions `json:"options"`
+	Profiles []string       `json:"profiles"`
+}
+
+func writeStreamResponse(w http.ResponseWriter) {
+	settings := getStreamSettings()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(streamResponse{
+		Settings: settings,
+		Options:  getEncoderOptions(settings.getCodec()),
+		Profiles: getQualityProfileNames(),
+	})
+}
+
+func getStreamHandler(w http.ResponseWriter, r *http.Request) {
+	writeStreamResponse(w)
+}
+
+func putStreamHandler(w http.ResponseWriter, r *http.Request) {
+	applyStreamMutex.Lock()
+	defer applyStreamMutex.Unlock()
+
+	old := getStreamSettings()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	// fields that are left out stay the same
+	updated := old
+
+	// changing profile resets what it controls,
+	// unless they're also set in the same request
+	var profile struct {
+		Profile *string `json:"profile"`
+	}
+	json.Unmarshal(body, &profile)
+	if profile.Profile != nil && *profile.Profile != old.Profile {
+		updated = old.withProfile(*profile.Profile)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(&updated)
+	if err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = updated.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = saveStreamSettings(updated)
+	if err != nil {
+		// still apply, it just wont survive a restart
+		slog.Error("failed to save stream settings", "err", err.Error())
+	}
+
+	if updated != old {
+		slog.Info("stream settings changed", "settings", updated)
+		applyStreamSettings(old, updated)
+	}
+
+	writeStreamResponse(w)
+}
+
+func initStream(httpMux *http.ServeMux) {
+	err := getDefaultStreamSettings().validate()
+	if err != nil {
+		panic("invalid QUALITY_PROFILE: " + err.Error())
+	}
+
+	currentStreamSettings = loadStreamSettings()
+
+	httpMux.HandleFunc("GET /api/admin/stream", adminOnly(getStreamHandler))
+	httpMux.HandleFunc("PUT /api/admin/stream", adminOnly(putStreamHandler))
+}
@@ -6,47 +6,95 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/makinori/inu-desktop/src/config"
 )
 
 type Process struct {
-	ID         string
-	Start      func() error
+	ID string
+	// should return once the context is done
+	Start func(ctx context.Context) error
+	// everything below is guarded by the mutex,
+	// since the loop changes it whilst others read it
+	mutex      sync.Mutex
 	Stop       func()
 	Running    bool
 	nowRunning chan struct{}
+	removed    bool
+	// closed once removed and no longer running
+	exited chan struct{}
+
+	// failed in a row, for backing off
+	Failures  int
+	LastError string
+	// exited or restarted while it should have kept running
+	Restarts int
+}
+
+type ProcessStatus struct {
+	ID        string `json:"id"`
+	Running   bool   `json:"running"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+	Restarts  int    `json:"restarts"`
 }
 
 type Supervisor struct {
-	Processes   []*Process
-	RestartTime time.Duration
-	Running     bool
+	Processes      []*Process
+	processesMutex sync.RWMutex
+	RestartTime    time.Duration
+	// doubles every failure up to this
+	MaxRestartTime time.Duration
+	Running        bool
 }
 
 func New() *Supervisor {
 	return &Supervisor{
-		RestartTime: time.Second * 5,
+		RestartTime:    time.Second * 5,
+		MaxRestartTime: time.Minute,
+	}
+}
+
+func (supervisor *Supervisor) add(process *Process) {
+	supervisor.processesMutex.Lock()
+	defer supervisor.processesMutex.Unlock()
+
+	process.exited = make(chan struct{})
+
+	supervisor.Processes = append(supervisor.Processes, process)
+
+	// added after run
+	if supervisor.Running {
+		go supervisor.processLoop(process)
 	}
 }
 
 func (supervisor *Supervisor) AddSimple(id string, start func() error) {
-	supervisor.Processes = append(supervisor.Processes, &Process{
-		ID:         id,
-		Start:      start,
+	supervisor.add(&Process{
+		ID: id,
+		// cant be stopped, so the context is ignored
+		Start: func(ctx context.Context) error {
+			return start()
+		},
 		Running:    true,
 		nowRunning: make(chan struct{}, 1),
 	})
 }
 
 type Command struct {
-	ID          string
-	Command     string
-	Args        []string
+	ID      string
+	Command string
+	Args    []string
+	// if set, used instead of args and called on every start
+	GetArgs     func() []string
 	Env         []string
 	Dir         string
 	NoAutoStart bool
+	// interrupts first and waits this long before killing
+	GracefulStop time.Duration
 }
 
 func (supervisor *Supervisor) AddCommand(command Command) {
@@ -56,20 +104,23 @@ func (supervisor *Supervisor) AddCommand(command Command) {
 		nowRunning: make(chan struct{}, 1),
 	}
 
-	process.Start = func() error {
-		ctx, stop := context.WithCancel(
-			context.Background(),
-		)
-
-		process.Stop = func() {
-			slog.Info("stopping " + process.ID + "...")
-			stop()
+	process.Start = func(ctx context.Context) error {
+		args := command.Args
+		if command.GetArgs != nil {
+			args = command.GetArgs()
 		}
 
-		cmd := exec.CommandContext(ctx, command.Command, command.Args...)
+		cmd := exec.CommandContext(ctx, command.Command, args...)
 		cmd.Env = command.Env
 		cmd.Dir = command.Dir
 
+		if command.GracefulStop > 0 {
+			cmd.Cancel = func() error {
+				return cmd.Process.Signal(os.Interrupt)
+			}
+			cmd.WaitDelay = command.GracefulStop
+		}
+
 		if config.SUPERVISOR_LOGS {
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stdout
@@ -85,24 +136,135 @@ func (supervisor *Supervisor) AddCommand(command Command) {
 		return err
 	}
 
-	supervisor.Processes = append(supervisor.Processes, process)
+	supervisor.add(process)
+}
+
+type Func struct {
+	ID string
+	// should return once the context is done
+	Run         func(ctx context.Context) error
+	NoAutoStart bool
+}
+
+func (supervisor *Supervisor) AddFunc(function Func) {
+	var process *Process = &Process{
+		ID:         function.ID,
+		Running:    !function.NoAutoStart,
+		nowRunning: make(chan struct{}, 1),
+	}
+
+	process.Start = func(ctx context.Context) error {
+		err := function.Run(ctx)
+
+		// dont print error if the context was stopped
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		return err
+	}
+
+	supervisor.add(process)
+}
+
+// must be called with mutex locked
+func (process *Process) stop() {
+	if process.Stop != nil {
+		process.Stop()
+	}
 }
 
 func (supervisor *Supervisor) processLoop(process *Process) {
-	if process.Running {
+	process.mutex.Lock()
+	removed, running := process.removed, process.Running
+
+	// made before unlocking, so a stop or restart from now on cancels this run
+	// rather than the last one
+	ctx, cancel := context.WithCancel(context.Background())
+	if running && !removed {
+		process.Stop = func() {
+			slog.Info("stopping " + process.ID + "...")
+			cancel()
+		}
+	}
+	process.mutex.Unlock()
+
+	if removed {
+		cancel()
+		close(process.exited)
+		return
+	}
+	if running {
 		slog.Info("starting " + process.ID + "...")
-		err := process.Start()
+		started := time.Now()
+		err := process.Start(ctx)
+		cancel()
+
+		process.mutex.Lock()
 		if err != nil {
 			slog.Error(process.ID, "err", err.Error())
-			time.Sleep(supervisor.RestartTime)
+
+			// ran fine for a while, so this is a new problem
+			if time.Since(started) > supervisor.MaxRestartTime {
+				process.Failures = 0
+			}
+			process.Failures++
+			process.LastError = err.Error()
+		} else {
+			process.Failures = 0
+		}
+
+		if process.Running && !process.removed {
+			process.Restarts++
+		}
+
+		failures := process.Failures
+		process.mutex.Unlock()
+
+		if err != nil {
+			time.Sleep(supervisor.getRestartTime(failures))
 		}
 	} else {
+		cancel()
 		<-process.nowRunning
 	}
 	supervisor.processLoop(process)
 }
 
+func (supervisor *Supervisor) getRestartTime(failures int) time.Duration {
+	restartTime := supervisor.RestartTime
+	for range failures - 1 {
+		restartTime *= 2
+		if restartTime >= supervisor.MaxRestartTime {
+			return supervisor.MaxRestartTime
+		}
+	}
+	return restartTime
+}
+
+func (supervisor *Supervisor) Status() []ProcessStatus {
+	supervisor.processesMutex.RLock()
+	defer supervisor.processesMutex.RUnlock()
+
+	status := []ProcessStatus{}
+	for _, process := range supervisor.Processes {
+		process.mutex.Lock()
+		status = append(status, ProcessStatus{
+			ID:        process.ID,
+			Running:   process.Running,
+			Failures:  process.Failures,
+			LastError: process.LastError,
+			Restarts:  process.Restarts,
+		})
+		process.mutex.Unlock()
+	}
+	return status
+}
+
 func (supervisor *Supervisor) findByID(id string) *Process {
+	supervisor.processesMutex.RLock()
+	defer supervisor.processesMutex.RUnlock()
+
 	for _, process := range supervisor.Processes {
 		if process.ID == id {
 			return process
@@ -117,6 +279,9 @@ func (supervisor *Supervisor) Start(id string) error {
 		return errors.New("failed to find process")
 	}
 
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+
 	if process.Running {
 		return errors.New("process already running")
 	}
@@ -137,29 +302,116 @@ func (supervisor *Supervisor) Stop(id string) error {
 		return errors.New("failed to find process")
 	}
 
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+
 	if !process.Running {
 		return errors.New("process already stopped")
 	}
 
 	process.Running = false
+	process.stop()
 
-	if process.Stop != nil {
-		process.Stop()
+	return nil
+}
+
+func (supervisor *Supervisor) Has(id string) bool {
+	return supervisor.findByID(id) != nil
+}
+
+// stops the process and stops supervising it
+func (supervisor *Supervisor) Remove(id string) error {
+	supervisor.processesMutex.Lock()
+	i := slices.IndexFunc(supervisor.Processes, func(process *Process) bool {
+		return process.ID == id
+	})
+	if i < 0 {
+		supervisor.processesMutex.Unlock()
+		return errors.New("failed to find process")
+	}
+	process := supervisor.Processes[i]
+	supervisor.Processes = slices.Delete(supervisor.Processes, i, i+1)
+	supervisor.processesMutex.Unlock()
+
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+
+	process.removed = true
+
+	if process.Running {
+		process.Running = false
+		process.stop()
+	}
+
+	// wake up the loop so it can exit
+	if len(process.nowRunning) == 0 {
+		process.nowRunning <- struct{}{}
 	}
 
 	return nil
 }
 
+// like remove but waits for the process to exit
+func (supervisor *Supervisor) RemoveAndWait(
+	id string, timeout time.Duration,
+) error {
+	process := supervisor.findByID(id)
+	if process == nil {
+		return errors.New("failed to find process")
+	}
+
+	err := supervisor.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	supervisor.processesMutex.RLock()
+	running := supervisor.Running
+	supervisor.processesMutex.RUnlock()
+
+	// never started
+	if !running {
+		return nil
+	}
+
+	select {
+	case <-process.exited:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for process to exit")
+	}
+}
+
+// stops the process and lets the loop start it again
+func (supervisor *Supervisor) Restart(id string) error {
+	process := supervisor.findByID(id)
+	if process == nil {
+		return errors.New("failed to find process")
+	}
+
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+
+	if !process.Running {
+		return errors.New("process not running")
+	}
+
+	process.stop()
+
+	return nil
+}
+
 func (supervisor *Supervisor) Run() {
 	if supervisor.Running {
 		return
 	}
 
+	supervisor.processesMutex.Lock()
 	supervisor.Running = true
-
 	for _, process := range supervisor.Processes {
 		go supervisor.processLoop(process)
 	}
+	supervisor.processesMutex.Unlock()
 
 	select {}
 }
@@ -0,0 +1,165 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getStatus(supervisor *Supervisor, id string) ProcessStatus {
+	for _, status := range supervisor.Status() {
+		if status.ID == id {
+			return status
+		}
+	}
+	return ProcessStatus{}
+}
+
+func waitForStatus(
+	t *testing.T, supervisor *Supervisor, id string,
+	check func(ProcessStatus) bool,
+) ProcessStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := getStatus(supervisor, id)
+		if check(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected status %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFailuresAreCounted(t *testing.T) {
+	supervisor := New()
+	supervisor.RestartTime = time.Millisecond
+	supervisor.MaxRestartTime = time.Millisecond * 10
+
+	supervisor.AddFunc(Func{
+		ID: "failing",
+		Run: func(ctx context.Context) error {
+			return errors.New("failed")
+		},
+	})
+
+	go supervisor.Run()
+
+	// read whilst the loop is writing
+	status := waitForStatus(t, supervisor, "failing", func(status ProcessStatus) bool {
+		return status.Failures >= 3 && status.Restarts >= 3
+	})
+
+	if status.LastError != "failed" {
+		t.Errorf("unexpected last error %q", status.LastError)
+	}
+
+	err := supervisor.RemoveAndWait("failing", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartStopRestart(t *testing.T) {
+	supervisor := New()
+
+	started := make(chan struct{}, 10)
+
+	supervisor.AddFunc(Func{
+		ID: "func",
+		Run: func(ctx context.Context) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return nil
+		},
+		NoAutoStart: true,
+	})
+
+	go supervisor.Run()
+
+	waitStarted := func() {
+		t.Helper()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("process didnt start")
+		}
+	}
+
+	err := supervisor.Start("func")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStarted()
+
+	err = supervisor.Restart("func")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStarted()
+
+	waitForStatus(t, supervisor, "func", func(status ProcessStatus) bool {
+		return status.Running && status.Restarts == 1
+	})
+
+	err = supervisor.Stop("func")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if getStatus(supervisor, "func").Running {
+		t.Error("still running after stop")
+	}
+
+	err = supervisor.Restart("func")
+	if err == nil {
+		t.Error("restarted a stopped process")
+	}
+
+	err = supervisor.RemoveAndWait("func", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a stop can land as soon as the loop decides to start, so it has to cancel
+// the run thats about to begin rather than the last one
+func TestStopBeforeStartIsntLost(t *testing.T) {
+	supervisor := New()
+
+	var stopped atomic.Bool
+
+	supervisor.add(&Process{
+		ID: "process",
+		Start: func(ctx context.Context) error {
+			if !stopped.Swap(true) {
+				supervisor.Stop("process")
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Error("stop was lost")
+			}
+			return nil
+		},
+		Running:    true,
+		nowRunning: make(chan struct{}, 1),
+	})
+
+	go supervisor.Run()
+
+	waitForStatus(t, supervisor, "process", func(status ProcessStatus) bool {
+		return stopped.Load() && !status.Running
+	})
+
+	err := supervisor.RemoveAndWait("process", 6*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/makinori/inu-desktop/src/config"
+	"github.com/makinori/inu-desktop/src/inuwebrtc"
+	"github.com/makinori/inu-desktop/src/x11"
+)
+
+var (
+	// stops following the window size
+	windowCancels      = map[uint32]context.CancelFunc{}
+	windowCancelsMutex sync.Mutex
+)
+
+func getWindowProcessID(xid uint32) string {
+	return fmt.Sprintf("gst-window-%d", xid)
+}
+
+// encoders want even dimensions
+func getWindowSize(geometry x11.Geometry) (int, int) {
+	return max(geometry.Width&^1, 2), max(geometry.Height&^1, 2)
+}
+
+func getWindowPipeline(stream inuwebrtc.WindowStream) []string {
+	xid := stream.XID
+	settings := getStreamSettings().getFallback()
+
+	width, height := config.SCREEN_WIDTH, config.SCREEN_HEIGHT
+
+	geometry, ok := x11.GetWindowGeometry(xid)
+	if ok {
+		width, height = getWindowSize(geometry)
+	}
+
+	elements := []string{
+		fmt.Sprintf(
+			"ximagesrc xid=%d use-damage=false show-pointer=false", xid,
+		),
+		fmt.Sprintf("video/x-raw,framerate=%d/1", settings.Framerate),
+		"videoscale",
+		fmt.Sprintf("video/x-raw,width=%d,height=%d", width, height),
+	}
+	elements = append(elements, getVideoEncoding(settings)...)
+
+	return append(elements, rtpSink(getWindowProcessID(xid), stream.Write))
+}
+
+// caps are fixed once negotiated, so restart when the window resizes
+func followWindowSize(ctx context.Context, xid uint32) {
+	geometry, _ := x11.GetWindowGeometry(xid)
+	width, height := getWindowSize(geometry)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// viewers are closed, which removes the pipeline
+		if !x11.IsClientWindow(xid) {
+			slog.Info("window closed", "xid", xid)
+			inuwebrtc.CloseWindowStream(xid)
+			return
+		}
+
+		geometry, ok := x11.GetWindowGeometry(xid)
+		if !ok {
+			continue
+		}
+
+		newWidth, newHeight := getWindowSize(geometry)
+		if newWidth == width && newHeight == height {
+			continue
+		}
+
+		width, height = newWidth, newHeight
+
+		slog.Info("window resized", "xid", xid, "width", width, "height", height)
+		processes.Restart(getWindowProcessID(xid))
+	}
+}
+
+func startWindowPipeline(stream inuwebrtc.WindowStream) {
+	id := getWindowProcessID(stream.XID)
+	if processes.Has(id) {
+		return
+	}
+
+	addPipeline(pipeline{
+		ID: id,
+		GetElements: func() []string {
+			return getWindowPipeline(stream)
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	windowCancelsMutex.Lock()
+	windowCancels[stream.XID] = cancel
+	windowCancelsMutex.Unlock()
+
+	go followWindowSize(ctx, stream.XID)
+}
+
+func stopWindowPipeline(stream inuwebrtc.WindowStream) {
+	id := getWindowProcessID(stream.XID)
+	processes.Remove(id)
+	releaseRTPSink(id)
+
+	windowCancelsMutex.Lock()
+	cancel, exists := windowCancels[stream.XID]
+	delete(windowCancels, stream.XID)
+	windowCancelsMutex.Unlock()
+
+	if exists {
+		cancel()
+	}
+}
+
+func windowsHandler(w http.ResponseWriter, r *http.Request) {
+	var windows []x11.Window
+	if config.IN_CONTAINER {
+		windows = x11.ListWindows()
+	}
+	if windows == nil {
+		windows = []x11.Window{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(windows)
+}
+
+func initWindows(httpMux *http.ServeMux) {
+	// titles can give away whats on the desktop
+	httpMux.HandleFunc("GET /api/windows", controllerOnly(windowsHandler))
+
+	inuwebrtc.WindowStreamSignal.AddListener(
+		func(ctx context.Context, stream inuwebrtc.WindowStream) {
+			if stream.Active {
+				startWindowPipeline(stream)
+			} else {
+				stopWindowPipeline(stream)
+			}
+		},
+	)
+}
@@ -0,0 +1,140 @@
+package x11
+
+/*
+#cgo LDFLAGS: -lX11 -lXfixes
+#include <X11/Xlib.h>
+#include <X11/extensions/Xfixes.h>
+
+static int eventType(XEvent *event) {
+	return event->type;
+}
+*/
+import "C"
+import (
+	"errors"
+	"time"
+	"unsafe"
+)
+
+type Cursor struct {
+	Serial uint32
+	Width  int
+	Height int
+	XHot   int
+	YHot   int
+	// non-premultiplied
+	RGBA []byte
+}
+
+func getCursorImage(display *C.Display) (Cursor, bool) {
+	image := C.XFixesGetCursorImage(display)
+	if image == nil {
+		return Cursor{}, false
+	}
+	defer C.XFree(unsafe.Pointer(image))
+
+	cursor := Cursor{
+		Serial: uint32(image.cursor_serial),
+		Width:  int(image.width),
+		Height: int(image.height),
+		XHot:   int(image.xhot),
+		YHot:   int(image.yhot),
+	}
+
+	// pixels are premultiplied argb stored in longs
+	pixels := unsafe.Slice(image.pixels, cursor.Width*cursor.Height)
+	cursor.RGBA = make([]byte, len(pixels)*4)
+
+	for i, pixel := range pixels {
+		a := uint32(pixel>>24) & 0xff
+		r := uint32(pixel>>16) & 0xff
+		g := uint32(pixel>>8) & 0xff
+		b := uint32(pixel) & 0xff
+
+		if a > 0 && a < 255 {
+			r = min(r*255/a, 255)
+			g = min(g*255/a, 255)
+			b = min(b*255/a, 255)
+		}
+
+		cursor.RGBA[i*4] = byte(r)
+		cursor.RGBA[i*4+1] = byte(g)
+		cursor.RGBA[i*4+2] = byte(b)
+		cursor.RGBA[i*4+3] = byte(a)
+	}
+
+	return cursor, true
+}
+
+// blocks forever. uses its own display since xlib isnt thread safe
+func WatchCursor(
+	fps int, onImage func(Cursor), onPosition func(x int, y int),
+) error {
+	display := C.XOpenDisplay(nil)
+	if display == nil {
+		return errors.New("cannot open display for cursor")
+	}
+	defer C.XCloseDisplay(display)
+
+	var eventBase, errorBase C.int
+	if C.XFixesQueryExtension(display, &eventBase, &errorBase) == 0 {
+		return errors.New("xfixes not available")
+	}
+
+	root := C.XDefaultRootWindow(display)
+
+	C.XFixesSelectCursorInput(
+		display, root, C.XFixesDisplayCursorNotifyMask,
+	)
+
+	cursor, ok := getCursorImage(display)
+	if ok {
+		onImage(cursor)
+	}
+
+	lastX, lastY := -1, -1
+
+	// there's no event for pointer motion on the root window
+	// without grabbing, so poll it instead
+	ticker := time.NewTicker(time.Second / time.Duration(max(fps, 1)))
+	defer ticker.Stop()
+
+	var event C.XEvent
+
+	for range ticker.C {
+		changed := false
+		for C.XPending(display) > 0 {
+			C.XNextEvent(display, &event)
+			if C.eventType(&event) == eventBase+C.XFixesCursorNotify {
+				changed = true
+			}
+		}
+
+		if changed {
+			cursor, ok := getCursorImage(display)
+			if ok {
+				onImage(cursor)
+			}
+		}
+
+		var rootReturn, childReturn C.Window
+		var x, y, winX, winY C.int
+		var mask C.uint
+
+		if C.XQueryPointer(
+			display, root, &rootReturn, &childReturn,
+			&x, &y, &winX, &winY, &mask,
+		) == 0 {
+			continue
+		}
+
+		if int(x) == lastX && int(y) == lastY {
+			continue
+		}
+
+		lastX, lastY = int(x), int(y)
+		onPosition(lastX, lastY)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package x11
+
+/*
+#cgo LDFLAGS: -lX11 -lXdamage -lXfixes
+#include <X11/Xlib.h>
+#include <X11/extensions/Xdamage.h>
+
+static int eventType(XEvent *event) {
+	return event->type;
+}
+*/
+import "C"
+import (
+	"errors"
+)
+
+// blocks forever, calling onDamage whenever the screen changes.
+// uses its own display since xlib isnt thread safe
+func WatchDamage(onDamage func()) error {
+	display := C.XOpenDisplay(nil)
+	if display == nil {
+		return errors.New("cannot open display for damage")
+	}
+	defer C.XCloseDisplay(display)
+
+	var eventBase, errorBase C.int
+	if C.XDamageQueryExtension(display, &eventBase, &errorBase) == 0 {
+		return errors.New("xdamage not available")
+	}
+
+	root := C.XDefaultRootWindow(display)
+
+	// only notifies when going from no damage to some damage,
+	// so subtract after every event to get the next one
+	damage := C.XDamageCreate(
+		display, C.Drawable(root), C.XDamageReportNonEmpty,
+	)
+	defer C.XDamageDestroy(display, damage)
+
+	var event C.XEvent
+
+	for {
+		C.XNextEvent(display, &event)
+
+		if C.eventType(&event) != eventBase+C.XDamageNotify {
+			continue
+		}
+
+		C.XDamageSubtract(display, damage, C.None, C.None)
+
+		onDamage()
+	}
+}
@@ -0,0 +1,210 @@
+package x11
+
+/*
+#include <stdlib.h>
+#include <X11/Xlib.h>
+#include <X11/Xatom.h>
+*/
+import "C"
+import (
+	"slices"
+	"unsafe"
+)
+
+type Window struct {
+	XID  uint32 `json:"xid"`
+	Name string `json:"name"`
+}
+
+type Geometry struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+func (g Geometry) Contains(x int, y int) bool {
+	return x >= g.X && y >= g.Y && x < g.X+g.Width && y < g.Y+g.Height
+}
+
+// must be called with displayMutex locked
+func getAtom(name string) C.Atom {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	return C.XInternAtom(display, cName, C.False)
+}
+
+// returns nil if the property doesnt exist. data is in longs for format 32
+func getProperty(
+	window C.Window, property C.Atom, propertyType C.Atom,
+) (unsafe.Pointer, int) {
+	var actualType C.Atom
+	var actualFormat C.int
+	var items, bytesAfter C.ulong
+	var data *C.uchar
+
+	status := C.XGetWindowProperty(
+		display, window, property, 0, 1024, C.False, propertyType,
+		&actualType, &actualFormat, &items, &bytesAfter, &data,
+	)
+
+	if status != C.Success || data == nil {
+		return nil, 0
+	}
+
+	if items == 0 {
+		C.XFree(unsafe.Pointer(data))
+		return nil, 0
+	}
+
+	return unsafe.Pointer(data), int(items)
+}
+
+func getWindowName(window C.Window) string {
+	data, items := getProperty(
+		window, getAtom("_NET_WM_NAME"), getAtom("UTF8_STRING"),
+	)
+	if data != nil {
+		defer C.XFree(data)
+		return C.GoStringN((*C.char)(data), C.int(items))
+	}
+
+	var name *C.char
+	if C.XFetchName(display, window, &name) == 0 || name == nil {
+		return ""
+	}
+	defer C.XFree(unsafe.Pointer(name))
+
+	return C.GoString(name)
+}
+
+// must be called with displayMutex locked
+func getClientWindows() []C.Window {
+	if !ensureConnected() {
+		return nil
+	}
+
+	data, items := getProperty(
+		rootWindow, getAtom("_NET_CLIENT_LIST"), C.XA_WINDOW,
+	)
+	if data == nil {
+		return nil
+	}
+	defer C.XFree(data)
+
+	xids := unsafe.Slice((*C.ulong)(data), items)
+
+	windows := make([]C.Window, len(xids))
+	for i, xid := range xids {
+		windows[i] = C.Window(xid)
+	}
+
+	return windows
+}
+
+// top level windows managed by the window manager
+func ListWindows() []Window {
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	clientWindows := getClientWindows()
+	if clientWindows == nil {
+		return nil
+	}
+
+	windows := make([]Window, 0, len(clientWindows))
+	for _, window := range clientWindows {
+		windows = append(windows, Window{
+			XID:  uint32(window),
+			Name: getWindowName(window),
+		})
+	}
+
+	return windows
+}
+
+// so only windows from ListWindows can be streamed or focused
+func IsClientWindow(xid uint32) bool {
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	return slices.Contains(getClientWindows(), C.Window(xid))
+}
+
+// position is relative to the root window
+func GetWindowGeometry(xid uint32) (Geometry, bool) {
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	if !ensureConnected() {
+		return Geometry{}, false
+	}
+
+	var attributes C.XWindowAttributes
+	if C.XGetWindowAttributes(
+		display, C.Window(xid), &attributes,
+	) == 0 {
+		return Geometry{}, false
+	}
+
+	var x, y C.int
+	var child C.Window
+	if C.XTranslateCoordinates(
+		display, C.Window(xid), rootWindow, 0, 0, &x, &y, &child,
+	) == 0 {
+		return Geometry{}, false
+	}
+
+	return Geometry{
+		X:      int(x),
+		Y:      int(y),
+		Width:  int(attributes.width),
+		Height: int(attributes.height),
+	}, true
+}
+
+func GetMousePos() (int, int, bool) {
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	if !ensureConnected() {
+		return 0, 0, false
+	}
+
+	var rootReturn, childReturn C.Window
+	var x, y, winX, winY C.int
+	var mask C.uint
+
+	if C.XQueryPointer(
+		display, rootWindow, &rootReturn, &childReturn,
+		&x, &y, &winX, &winY, &mask,
+	) == 0 {
+		return 0, 0, false
+	}
+
+	return int(x), int(y), true
+}
+
+func FocusWindow(xid uint32) {
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	if !ensureConnected() {
+		return
+	}
+
+	var focused C.Window
+	var revertTo C.int
+	C.XGetInputFocus(display, &focused, &revertTo)
+
+	if uint32(focused) == xid {
+		return
+	}
+
+	C.XRaiseWindow(display, C.Window(xid))
+	C.XSetInputFocus(
+		display, C.Window(xid), C.RevertToParent, C.CurrentTime,
+	)
+
+	C.XFlush(display)
+}
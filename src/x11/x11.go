@@ -4,20 +4,39 @@ package x11
 #cgo LDFLAGS: -lX11 -lXtst
 #include <X11/Xlib.h>
 #include <X11/extensions/XTest.h>
+
+// the default handler exits, and windows can go away at any time
+static int ignoreError(Display *display, XErrorEvent *event) {
+	return 0;
+}
+
+static void setErrorHandler() {
+	XSetErrorHandler(ignoreError);
+}
 */
 import "C"
 import (
 	"bytes"
 	"log/slog"
 	"os/exec"
+	"sync"
 )
 
 var (
 	display    *C.Display
 	rootWindow C.Window
+	// xlib isnt thread safe, anything using display needs this
+	displayMutex sync.Mutex
 )
 
-// TODO just make this an init function
+func init() {
+	// in process gstreamer uses xlib from its own threads too
+	C.XInitThreads()
+	C.setErrorHandler()
+}
+
+// TODO just make this an init function.
+// must be called with displayMutex locked
 func ensureConnected() bool {
 	if display != nil {
 		return true
@@ -49,7 +68,12 @@ func ensureConnected() bool {
 // }
 
 func MoveMouse(x int, y int) {
-	ensureConnected()
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	if !ensureConnected() {
+		return
+	}
 
 	C.XWarpPointer(
 		display, 0, rootWindow, 0, 0, 0, 0, C.int(x), C.int(y),
@@ -72,7 +96,12 @@ func ClickMouse(jsButton byte, down byte) {
 		return
 	}
 
-	ensureConnected()
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	if !ensureConnected() {
+		return
+	}
 
 	err := C.XTestFakeButtonEvent(
 		display, button, C.int(down), C.CurrentTime,
@@ -86,7 +115,12 @@ func ClickMouse(jsButton byte, down byte) {
 }
 
 func KeyPress(keysym uint32, down byte) {
-	ensureConnected()
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	if !ensureConnected() {
+		return
+	}
 
 	keycode := C.XKeysymToKeycode(display, C.KeySym(uint64(keysym)))
 
@@ -109,7 +143,12 @@ func ScrollMouse(scrollDown bool) {
 		cButton = 4 // scroll up
 	}
 
-	ensureConnected()
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	if !ensureConnected() {
+		return
+	}
 
 	err := C.XTestFakeButtonEvent(display, cButton, C.True, C.CurrentTime)
 	if err == 0 {